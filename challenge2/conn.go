@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SecureConn is a net.Conn encrypting everything written to
+// and decrypting everything read from the underlying connection.
+// Like a net.Conn it is full duplex: one goroutine may Read while
+// another one Writes, as reader and writer share no state but the
+// underlying connection. Concurrent Reads, or concurrent Writes,
+// need to be serialized by the caller.
+type SecureConn struct {
+	io.Reader
+	io.Writer
+	conn net.Conn
+}
+
+// NewClientConn secures an existing connection, e.g. one taken from
+// a pool, as the client: it performs the handshake over conn, bounded
+// by the HandshakeTimeout option, and returns the secured connection.
+// On error the caller should close conn.
+func NewClientConn(conn net.Conn, opts ...Option) (*SecureConn, error) {
+	return handshakeConn(conn, true, newOptions(opts))
+}
+
+// NewServerConn is like NewClientConn for the server end of conn.
+func NewServerConn(conn net.Conn, opts ...Option) (*SecureConn, error) {
+	return handshakeConn(conn, false, newOptions(opts))
+}
+
+func handshakeConn(conn net.Conn, client bool, o options) (*SecureConn, error) {
+	o.startHandshake(conn)
+	priv, peerPub, err := Handshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newSecureConn(conn, priv, peerPub, client)
+}
+
+// newSecureConn secures conn after the handshake yielded priv and
+// peerPub. Each direction uses its own key derived from the shared
+// secret, the client writing with the key the server reads with
+// and vice versa.
+func newSecureConn(conn net.Conn, priv, peerPub *[KeySize]byte, client bool) (*SecureConn, error) {
+	send, recv := clientToServer, serverToClient
+	if !client {
+		send, recv = recv, send
+	}
+	sendKey, err := deriveKey(priv, peerPub, send)
+	if err != nil {
+		return nil, err
+	}
+	recvKey, err := deriveKey(priv, peerPub, recv)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureConn{
+		&sR{r: conn, shared: recvKey, max: DefaultMaxMessageSize},
+		&sW{w: conn, shared: sendKey, rand: rand.Reader},
+		conn,
+	}, nil
+}
+
+// Loopback returns the client and the server end of a secured
+// in-memory connection built on net.Pipe, with the handshake done.
+// Like net.Pipe it is synchronous: a write blocks until the other
+// end read it. It comes in handy for tests not wanting sockets.
+func Loopback() (client, server *SecureConn, err error) {
+	c1, c2 := net.Pipe()
+	type result struct {
+		sc  *SecureConn
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		sc, err := NewServerConn(c2)
+		res <- result{sc, err}
+	}()
+	client, err = NewClientConn(c1)
+	if err != nil {
+		// unblocks the server's handshake
+		c1.Close()
+	}
+	r := <-res
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		c1.Close()
+		c2.Close()
+		return nil, nil, err
+	}
+	return client, r.sc, nil
+}
+
+// Flush makes sure everything written so far was handed to the
+// underlying connection, see the Flush method of SecureWriter.
+func (c *SecureConn) Flush() error {
+	if f, ok := c.Writer.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// ConnStats counts the traffic of a SecureConn.
+type ConnStats struct {
+	BytesIn, BytesOut   uint64 // plaintext read and written
+	FramesIn, FramesOut uint64 // frames read and written, pings included
+	DecryptFailures     uint64 // frames read that failed to open
+}
+
+// Stats returns the traffic so far. It may be called concurrently
+// with Read and Write.
+func (c *SecureConn) Stats() ConnStats {
+	var s ConnStats
+	if sr, ok := c.Reader.(*sR); ok {
+		s.BytesIn = atomic.LoadUint64(&sr.bytes)
+		s.FramesIn = atomic.LoadUint64(&sr.frames)
+		s.DecryptFailures = atomic.LoadUint64(&sr.failures)
+	}
+	if sw, ok := c.Writer.(*sW); ok {
+		s.BytesOut = atomic.LoadUint64(&sw.bytes)
+		s.FramesOut = atomic.LoadUint64(&sw.frames)
+	}
+	return s
+}
+
+// WritePing sends a heartbeat, see the WritePing method of SecureWriter.
+func (c *SecureConn) WritePing() error {
+	p, ok := c.Writer.(interface {
+		WritePing() error
+	})
+	if !ok {
+		return fmt.Errorf("%T cannot write pings", c.Writer)
+	}
+	return p.WritePing()
+}
+
+// ReadMessage returns the plaintext of the next frame, see the
+// ReadMessage method of SecureReader.
+func (c *SecureConn) ReadMessage() ([]byte, error) {
+	mr, ok := c.Reader.(MessageReader)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot read messages", c.Reader)
+	}
+	return mr.ReadMessage()
+}
+
+// WriteString is like Write for the bytes of s.
+func (c *SecureConn) WriteString(s string) (int, error) {
+	return io.WriteString(c.Writer, s)
+}
+
+// WriteMessage seals p into exactly one frame, see the WriteMessage
+// method of SecureWriter.
+func (c *SecureConn) WriteMessage(p []byte) error {
+	mw, ok := c.Writer.(MessageWriter)
+	if !ok {
+		return fmt.Errorf("%T cannot write messages", c.Writer)
+	}
+	return mw.WriteMessage(p)
+}
+
+// Close flushes and then closes the underlying connection.
+func (c *SecureConn) Close() error {
+	err := c.Flush()
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseWrite flushes and then shuts down the writing side of the
+// underlying connection, so the peer reads io.EOF once it got all
+// frames written so far, while the reading side remains open for
+// its reply.
+func (c *SecureConn) CloseWrite() error {
+	cw, ok := c.conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return fmt.Errorf("%T does not support half-close", c.conn)
+	}
+	err := c.Flush()
+	if cerr := cw.CloseWrite(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (c *SecureConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (c *SecureConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying connection.
+func (c *SecureConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *SecureConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *SecureConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
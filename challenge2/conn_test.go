@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDialReturnsNetConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var c interface{} = conn
+	nc, ok := c.(net.Conn)
+	if !ok {
+		t.Fatalf("Unexpected result: %T is not a net.Conn", conn)
+	}
+	if nc.RemoteAddr() == nil {
+		t.Fatal("Unexpected result: no remote address")
+	}
+	if got, expected := nc.RemoteAddr().String(), l.Addr().String(); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	addr := l.Addr().String()
+	if !strings.HasPrefix(addr, "[::1]:") {
+		t.Fatalf("Unexpected listener address %s", addr)
+	}
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := DialFrom("127.0.0.1:0", l.Addr().String(), WithBufferSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if chunk := conn.Writer.(*sW).chunk; chunk != 4 {
+		t.Fatalf("Unexpected result: chunk size %d, expected 4", chunk)
+	}
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Unexpected result: local address %s", conn.LocalAddr())
+	}
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+
+	if _, err := DialFrom("not an address", l.Addr().String()); err == nil {
+		t.Fatal("Unexpected result: dialed from an invalid local address")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// echo a single message
+	go io.CopyN(server, server, 12)
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(client, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+}
+
+func TestNewClientServerConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// echo on the server end
+	errc := make(chan error, 1)
+	go func() {
+		server, err := NewServerConn(c2)
+		if err != nil {
+			errc <- err
+			return
+		}
+		_, err = io.Copy(server, server)
+		errc <- err
+	}()
+
+	client, err := NewClientConn(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(client, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+	client.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecureConnFullDuplex(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	go io.Copy(server, server)
+
+	const messages = 1000
+	expected := new(bytes.Buffer)
+	for i := 0; i < messages; i++ {
+		fmt.Fprintf(expected, "message %d\n", i)
+	}
+	go func() {
+		for i := 0; i < messages; i++ {
+			if _, err := fmt.Fprintf(client, "message %d\n", i); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	got := make([]byte, expected.Len())
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected.Bytes()) {
+		t.Fatalf("Unexpected result:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestSecureConnFlushClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		server, err := NewServerConn(c2)
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		b, _ := ioutil.ReadAll(server)
+		received <- b
+	}()
+
+	client, err := NewClientConn(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// less than a chunk, right before closing
+	if _, err := fmt.Fprint(client, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(<-received); got != "bye" {
+		t.Fatalf("Unexpected result: %q != %q", got, "bye")
+	}
+}
+
+func TestSecureWriterFlush(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriter(bufio.NewWriter(wire), priv, pub)
+	fmt.Fprint(secureW, "hello world\n")
+	if wire.Len() != 0 {
+		t.Fatalf("Unexpected result: %d bytes passed the buffer", wire.Len())
+	}
+	if err := secureW.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := NewSecureReader(wire, priv, pub).Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello world\n" {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+}
+
+func TestSecureConnStats(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, m := range []string{"a", "bb", "ccc"} {
+			fmt.Fprint(client, m)
+		}
+		client.WritePing()
+		fmt.Fprint(client, "dddd")
+	}()
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	expected := ConnStats{BytesOut: 10, FramesOut: 5}
+	if got := client.Stats(); got != expected {
+		t.Fatalf("Unexpected client stats %+v, expected %+v", got, expected)
+	}
+	expected = ConnStats{BytesIn: 10, FramesIn: 5}
+	if got := server.Stats(); got != expected {
+		t.Fatalf("Unexpected server stats %+v, expected %+v", got, expected)
+	}
+
+	// a frame sealed with another key
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	wire := new(bytes.Buffer)
+	fmt.Fprint(NewSecureWriter(wire, priv, pub), "hello world\n")
+	sc := &SecureConn{Reader: NewSecureReader(wire, &[32]byte{'o', 't', 'h', 'e', 'r'}, pub)}
+	sc.Read(buf)
+	if got := sc.Stats(); got != (ConnStats{DecryptFailures: 1}) {
+		t.Fatalf("Unexpected stats %+v", got)
+	}
+}
+
+func TestSecureConnScanner(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// three messages in a single frame
+	go func() {
+		fmt.Fprint(client, "hello\nworld\nbye\n")
+		client.Close()
+	}()
+
+	var lines []string
+	scanner := bufio.NewScanner(server)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(lines, ","); got != "hello,world,bye" {
+		t.Fatalf("Unexpected result: %q", lines)
+	}
+	if n := server.Stats().FramesIn; n != 1 {
+		t.Fatalf("Unexpected result: opened %d frames, expected 1", n)
+	}
+}
+
+func TestSecureConnWriteMessage(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// one frame each, beyond the chunk size too
+	messages := []string{"hello world\n", strings.Repeat("x", DefaultChunkSize+1), "bye"}
+	go func() {
+		if _, err := client.WriteString(messages[0]); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, m := range messages[1:] {
+			if err := client.WriteMessage([]byte(m)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, expected := range messages {
+		m, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != expected {
+			t.Fatalf("Unexpected result: %d bytes, expected %d", len(m), len(expected))
+		}
+	}
+}
+
+func TestSecureConnReadMessage(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	messages := []string{"hello world\n", "second", "bye"}
+	go func() {
+		for _, m := range messages {
+			if _, err := io.WriteString(client, m); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for _, expected := range messages {
+		m, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != expected {
+			t.Fatalf("Unexpected result: %q != %q", m, expected)
+		}
+	}
+}
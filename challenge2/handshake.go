@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Labels of the keys derived for each direction of a connection.
+const (
+	clientToServer = "golang-challenge v1 client to server"
+	serverToClient = "golang-challenge v1 server to client"
+)
+
+// Handshake generates a private/public key pair, exchanges public
+// keys with the peer over conn and returns our private key along
+// with the peer's public key.
+// Each key is preceded by the ProtocolVersion byte, a peer sending
+// another version fails the handshake with ErrUnsupportedVersion.
+// Our key is written concurrently with reading the peer's, so both
+// ends may call Handshake at the same time even over an unbuffered
+// transport like net.Pipe. On error the caller should close conn.
+func Handshake(conn io.ReadWriter) (priv, peerPub *[KeySize]byte, err error) {
+	return HandshakeRand(conn, rand.Reader)
+}
+
+// HandshakeRand is like Handshake but generates the key pair
+// from rand instead of crypto/rand.
+func HandshakeRand(conn io.ReadWriter, rand io.Reader) (priv, peerPub *[KeySize]byte, err error) {
+	return handshake(conn, rand, ProtocolVersion)
+}
+
+// handshake exchanges keys advertising version.
+func handshake(conn io.ReadWriter, rand io.Reader, version byte) (priv, peerPub *[KeySize]byte, err error) {
+	pub, priv, err := box.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handshakeKey(conn, pub, priv, version)
+}
+
+// handshakeKey exchanges keys presenting pub, the public key of priv.
+func handshakeKey(conn io.ReadWriter, pub, priv *[KeySize]byte, version byte) (*[KeySize]byte, *[KeySize]byte, error) {
+	werr := make(chan error, 1)
+	go func() {
+		n, err := conn.Write(append([]byte{version}, pub[:]...))
+		if err == nil && n != 1+KeySize {
+			err = fmt.Errorf("%w of pub key: %d bytes", ErrPartialWrite, n)
+		}
+		werr <- err
+	}()
+
+	// the key may arrive in several reads over a slow link
+	var v [1]byte
+	if _, err := io.ReadFull(conn, v[:]); err != nil {
+		return nil, nil, err
+	}
+	if v[0] != version {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, v[0])
+	}
+	peerPub := new([KeySize]byte)
+	if n, err := io.ReadFull(conn, peerPub[:]); err == io.ErrUnexpectedEOF {
+		return nil, nil, fmt.Errorf("%w: %d", ErrIllegalKeySize, n)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if err := <-werr; err != nil {
+		return nil, nil, err
+	}
+	if *peerPub == *pub {
+		return nil, nil, ErrReflectedKey
+	}
+	// a zero key makes a predictable shared secret
+	if *peerPub == ([KeySize]byte{}) {
+		return nil, nil, ErrWeakKey
+	}
+	if l := logger(); l != nil {
+		l.Printf("handshake complete: pub %x, peer %x", pub[:], peerPub[:])
+	}
+	return priv, peerPub, nil
+}
+
+// deriveKey derives the key for the direction named by label
+// from the box shared secret of priv and peerPub with HKDF-SHA256.
+// Both ends derive the same key for the same label.
+func deriveKey(priv, peerPub *[KeySize]byte, label string) (*[KeySize]byte, error) {
+	var shared [KeySize]byte
+	box.Precompute(&shared, peerPub, priv)
+	key := new([KeySize]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], nil, []byte(label)), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
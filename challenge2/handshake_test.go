@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type keys struct {
+		priv, peerPub *[KeySize]byte
+		err           error
+	}
+	res := make(chan keys)
+	go func() {
+		priv, peerPub, err := Handshake(c2)
+		res <- keys{priv, peerPub, err}
+	}()
+	priv, peerPub, err := Handshake(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-res
+	if peer.err != nil {
+		t.Fatal(peer.err)
+	}
+
+	// both ends must agree on the keys
+	go fmt.Fprintf(NewSecureWriter(c1, priv, peerPub), "hello world\n")
+	buf := make([]byte, 1024)
+	n, err := NewSecureReader(c2, peer.priv, peer.peerPub).Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(buf[:n]); res != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
+	}
+}
+
+// fakeConn reads from r and accepts at most max bytes per write.
+type fakeConn struct {
+	r   io.Reader
+	max int
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	if len(p) > c.max {
+		return c.max, nil
+	}
+	return len(p), nil
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	tData := []struct {
+		name string
+		conn io.ReadWriter
+		err  error
+	}{
+		{"partial write", &fakeConn{bytes.NewReader(append([]byte{ProtocolVersion}, make([]byte, KeySize)...)), 8}, ErrPartialWrite},
+		{"short key", &fakeConn{bytes.NewReader(append([]byte{ProtocolVersion}, make([]byte, 5)...)), 1 + KeySize}, ErrIllegalKeySize},
+		{"unsupported version", &fakeConn{bytes.NewReader(append([]byte{ProtocolVersion + 1}, make([]byte, KeySize)...)), 1 + KeySize}, ErrUnsupportedVersion},
+		{"zero key", &fakeConn{bytes.NewReader(append([]byte{ProtocolVersion}, make([]byte, KeySize)...)), 1 + KeySize}, ErrWeakKey},
+	}
+	for _, exp := range tData {
+		_, _, err := Handshake(exp.conn)
+		if !errors.Is(err, exp.err) {
+			t.Fatalf("%s: unexpected error: %v, expected %v", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestHandshakeSlowReads(t *testing.T) {
+	key := make([]byte, KeySize)
+	for i := range key {
+		key[i] = byte(i + 1)
+	}
+	// the peer's key arrives one byte at a time
+	r := iotest.OneByteReader(bytes.NewReader(append([]byte{ProtocolVersion}, key...)))
+	_, peerPub, err := Handshake(&fakeConn{r, 1 + KeySize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peerPub[:], key) {
+		t.Fatalf("Unexpected result: peer key %x, expected %x", peerPub[:], key)
+	}
+}
+
+func TestHandshakeLogging(t *testing.T) {
+	logs := new(syncBuffer)
+	SetLogger(log.New(logs, "", 0))
+	defer SetLogger(nil)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go Handshake(c2)
+	if _, _, err := Handshake(c1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "handshake complete") {
+		t.Fatalf("Unexpected result: no handshake complete in log:\n%s", logs)
+	}
+}
+
+func TestHandshakeReflectedKey(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// send our own key back
+	go func() {
+		key := make([]byte, 1+KeySize)
+		if _, err := io.ReadFull(c2, key); err != nil {
+			return
+		}
+		c2.Write(key)
+	}()
+	if _, _, err := Handshake(c1); !errors.Is(err, ErrReflectedKey) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrReflectedKey)
+	}
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go ServeWithHandler(l, func(err error) { errc <- err })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a newer client against this server
+	if _, _, err := handshake(conn, crand.Reader, ProtocolVersion+1); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Unexpected client error: %v, expected %v", err, ErrUnsupportedVersion)
+	}
+	if err := <-errc; !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Unexpected server error: %v, expected %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestDirectionalKeys(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+
+	// both ends derive the same key per label, but not across labels
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+	c2s, err := deriveKey(priv, pub, clientToServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2c, err := deriveKey(priv, pub, serverToClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := new(bytes.Buffer)
+	fmt.Fprint(&sW{w: wire, shared: c2s, rand: crand.Reader}, expected)
+	sealed := wire.Bytes()
+	if _, err := (&sR{r: bytes.NewReader(sealed), shared: s2c, max: DefaultMaxMessageSize}).Read(buf); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrDecryptFailed)
+	}
+	if _, err := (&sR{r: bytes.NewReader(sealed), shared: c2s, max: DefaultMaxMessageSize}).Read(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeRejectsZeroKey(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go ServeWithHandler(l, func(err error) { errc <- err })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	key := [1 + KeySize]byte{ProtocolVersion}
+	if _, err := conn.Write(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("Unexpected server error: %v, expected %v", err, ErrWeakKey)
+	}
+}
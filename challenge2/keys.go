@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// GenerateKeyPair generates a public/private key pair from crypto/rand.
+func GenerateKeyPair() (pub, priv *[KeySize]byte, err error) {
+	return box.GenerateKey(rand.Reader)
+}
+
+// SaveKeyPair writes pub and priv hex encoded to the file at path,
+// one per line, creating it readable by the owner only.
+func SaveKeyPair(path string, pub, priv *[KeySize]byte) error {
+	data := fmt.Sprintf("%x\n%x\n", pub[:], priv[:])
+	return ioutil.WriteFile(path, []byte(data), 0600)
+}
+
+// LoadKeyPair reads a key pair from a file written by SaveKeyPair.
+func LoadKeyPair(path string) (pub, priv *[KeySize]byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := bytes.Fields(data)
+	if len(lines) != 2 {
+		return nil, nil, fmt.Errorf("%s: want 2 keys, got %d", path, len(lines))
+	}
+	keys := make([]*[KeySize]byte, 2)
+	for i, line := range lines {
+		if len(line) != 2*KeySize {
+			return nil, nil, fmt.Errorf("%s: %w: %d", path, ErrIllegalKeySize, len(line)/2)
+		}
+		keys[i] = new([KeySize]byte)
+		if _, err := hex.Decode(keys[i][:], line); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return keys[0], keys[1], nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoadKeyPair(t *testing.T) {
+	pub, priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server.key")
+	if err := SaveKeyPair(path, pub, priv); err != nil {
+		t.Fatal(err)
+	}
+	gotPub, gotPriv, err := LoadKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *gotPub != *pub || *gotPriv != *priv {
+		t.Fatalf("Unexpected result: loaded %x %x, expected %x %x", gotPub[:], gotPriv[:], pub[:], priv[:])
+	}
+
+	if err := ioutil.WriteFile(path, []byte("abcd\nef01\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadKeyPair(path); !errors.Is(err, ErrIllegalKeySize) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrIllegalKeySize)
+	}
+}
+
+func TestServeWithKey(t *testing.T) {
+	pub, priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeWithKey(l, priv, pub)
+
+	// every connection sees the same server key
+	for i := 0; i < 2; i++ {
+		conn, err := DialAuthenticated(l.Addr().String(), pub, WithBufferSize(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunk := conn.Writer.(*sW).chunk; chunk != 4 {
+			t.Fatalf("Unexpected result: chunk size %d, expected 4", chunk)
+		}
+		expected := "hello world\n"
+		if _, err := fmt.Fprint(conn, expected); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); got != expected {
+			t.Fatalf("Unexpected result: %s != %s", got, expected)
+		}
+		conn.Close()
+	}
+}
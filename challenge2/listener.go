@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// NewSecureListener wraps l so that Accept returns secured
+// connections, letting existing accept loops serve the secure
+// protocol unchanged. Of opts only HandshakeTimeout applies.
+func NewSecureListener(l net.Listener, opts ...Option) net.Listener {
+	sl := &secureListener{
+		Listener: l,
+		o:        newOptions(opts),
+		conns:    make(chan *SecureConn),
+		errc:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go sl.serve()
+	return sl
+}
+
+type secureListener struct {
+	net.Listener
+	o     options
+	conns chan *SecureConn // connections done with the handshake
+	errc  chan error       // errors of the underlying Accept
+	done  chan struct{}    // closed by Close
+	once  sync.Once
+}
+
+// serve accepts connections from the underlying listener until it is
+// closed, doing the handshake of each in its own goroutine, so a client
+// stalling the handshake does not hold up the ones behind it.
+func (l *secureListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errc <- err:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake secures conn as the server and hands it to Accept.
+func (l *secureListener) handshake(conn net.Conn) {
+	sc, err := handshakeConn(conn, false, l.o)
+	if err != nil {
+		conn.Close()
+		if lg := logger(); lg != nil {
+			lg.Printf("accept: %s: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	select {
+	case l.conns <- sc:
+	case <-l.done:
+		sc.Close()
+	}
+}
+
+// Accept waits for the next connection that completed the handshake as
+// the server, bounded by the HandshakeTimeout option, returning a
+// *SecureConn. Handshakes run concurrently, in the background.
+// Connections failing theirs are closed and skipped, the failure going
+// to the debug logger, so Accept only returns once a handshake
+// succeeded or the underlying Accept failed.
+func (l *secureListener) Accept() (net.Conn, error) {
+	select {
+	case sc := <-l.conns:
+		return sc, nil
+	case err := <-l.errc:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener. Connections completing their
+// handshake afterwards are closed instead of returned by Accept.
+func (l *secureListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
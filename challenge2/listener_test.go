@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSecureListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := NewSecureListener(l)
+	defer sl.Close()
+
+	// a plain echo server, unaware of the secure protocol
+	go func() {
+		for {
+			conn, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// a failed handshake does not stop the accept loop
+	plain, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(plain, "not a handshake")
+	plain.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("hello world %d\n", i)
+		if _, err := fmt.Fprint(conn, expected); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); got != expected {
+			t.Fatalf("Unexpected result: %s != %s", got, expected)
+		}
+		conn.Close()
+	}
+}
+
+func TestSecureListenerStalledClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := NewSecureListener(l)
+	defer sl.Close()
+
+	// connects but never sends its key
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	go func() {
+		conn, err := sl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	start := time.Now()
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Unexpected delay %v behind a stalled client", d)
+	}
+}
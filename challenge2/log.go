@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+var debugLog atomic.Value // *log.Logger
+
+// SetLogger sets the logger receiving debug events like completed
+// handshakes, bytes read and written, and decrypt failures.
+// A nil logger, the default, turns debug logging off.
+func SetLogger(l *log.Logger) {
+	debugLog.Store(l)
+}
+
+// logger returns the debug logger or nil if there is none.
+// Callers check for nil before formatting,
+// so the hot paths don't pay for disabled logging.
+func logger() *log.Logger {
+	l, _ := debugLog.Load().(*log.Logger)
+	return l
+}
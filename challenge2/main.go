@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
@@ -15,156 +24,694 @@ import (
 const (
 	KeySize   = 32
 	NonceSize = 24
+	// LenSize is the size of the big-endian frame length
+	// preceding each sealed message on the wire.
+	LenSize = 4
+	// DefaultMaxMessageSize is the largest message
+	// a SecureReader accepts unless told otherwise.
+	DefaultMaxMessageSize = 16 << 20 // 16M
+	// DefaultChunkSize is the largest part of a single Write
+	// a SecureWriter seals into one frame unless told otherwise.
+	DefaultChunkSize = 16 << 10 // 16K
+	// ProtocolVersion is the version byte preceding
+	// the public key sent in the handshake.
+	ProtocolVersion = 3
 )
 
-func genNonce() (*[NonceSize]byte, error) {
-	nonce := new([NonceSize]byte)
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
-		return nil, err
+// Frame types, the first byte of every sealed message.
+const (
+	frameData byte = iota // application data
+	framePing             // heartbeat without content
+)
+
+// Errors returned by the handshake and the secure reader.
+// They may be wrapped, test for them with errors.Is.
+var (
+	ErrPartialWrite   = errors.New("partial write")
+	ErrPartialRead    = errors.New("partial read")
+	ErrIllegalKeySize = errors.New("illegal key size")
+	ErrDecryptFailed  = errors.New("failed decrypting message")
+	ErrReplay         = errors.New("replayed nonce")
+	ErrKeyMismatch    = errors.New("server public key mismatch")
+	ErrReflectedKey   = errors.New("peer reflected our public key")
+	ErrTooLarge       = errors.New("message too large")
+	ErrFrameType      = errors.New("unknown frame type")
+
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrWeakKey            = errors.New("peer sent an all-zero public key")
+)
+
+func genNonce(rand io.Reader, nonce *[NonceSize]byte) error {
+	_, err := io.ReadFull(rand, nonce[:])
+	return err
+}
+
+// precompute returns the shared key of priv and pub, so that frames
+// are not paying for the key agreement each time, or nil without keys.
+func precompute(priv, pub *[KeySize]byte) *[KeySize]byte {
+	if priv == nil || pub == nil {
+		return nil
 	}
-	return nonce, nil
+	shared := new([KeySize]byte)
+	box.Precompute(shared, pub, priv)
+	return shared
+}
+
+// MessageReader is implemented by every SecureReader, reading the
+// plaintext of a frame at a time, see ReadMessage of SecureConn.
+type MessageReader interface {
+	io.Reader
+	ReadMessage() ([]byte, error)
+}
+
+// ResettableReader is implemented by every SecureReader, letting a
+// pool reuse it for another stream and keys, see its Reset method.
+type ResettableReader interface {
+	io.Reader
+	Reset(r io.Reader, priv, pub *[KeySize]byte)
 }
 
 // NewSecureReader instantiates a new SecureReader
 func NewSecureReader(r io.Reader, priv, pub *[KeySize]byte) io.Reader {
-	return &sR{r, priv, pub}
+	return NewSecureReaderSize(r, priv, pub, DefaultMaxMessageSize)
+}
+
+// NewSecureReaderSize instantiates a new SecureReader rejecting
+// messages larger than max bytes before reading them.
+func NewSecureReaderSize(r io.Reader, priv, pub *[KeySize]byte, max int) io.Reader {
+	return &sR{r: r, priv: priv, peerPub: pub, shared: precompute(priv, pub), max: max}
+}
+
+// NewForwardSecureReader instantiates a SecureReader for the frames
+// of a ForwardSecureWriter, opening each with priv and the ephemeral
+// public key that precedes its nonce. It opens any frame sealed to the
+// public key of priv: the sender is not authenticated, anyone knowing
+// that public key can write frames it accepts.
+func NewForwardSecureReader(r io.Reader, priv *[KeySize]byte) io.Reader {
+	return &sR{r: r, priv: priv, max: DefaultMaxMessageSize, forward: true}
+}
+
+// NewSecureReaderGzip instantiates a SecureReader for the frames of a
+// gzip SecureWriter, inflating every message after opening it.
+func NewSecureReaderGzip(r io.Reader, priv, pub *[KeySize]byte) io.Reader {
+	return &sR{r: r, priv: priv, peerPub: pub, shared: precompute(priv, pub), max: DefaultMaxMessageSize, gzip: true}
 }
 
 type sR struct {
+	// counters first for 64-bit alignment of atomic access
+	bytes, frames, failures uint64
+
 	r       io.Reader
 	priv    *[KeySize]byte
 	peerPub *[KeySize]byte
+	shared  *[KeySize]byte // precomputed key used instead of priv and peerPub
+	max     int            // largest message accepted
+	forward bool           // frames carry an ephemeral peer public key
+	gzip    bool           // messages are gzipped before sealing
+	buf     []byte         // decrypted but not yet delivered
+	seen    nonceSet
+
+	// scratch space reused by every frame, buf points into plain
+	ephPub [KeySize]byte
+	nonce  [NonceSize]byte
+	frame  []byte
+	plain  []byte
 }
 
+// maxSeenNonces bounds the replay protection of a SecureReader:
+// the last maxSeenNonces nonces are remembered, which costs
+// roughly 2*NonceSize bytes each (about 200k in total).
+const maxSeenNonces = 1 << 12
+
+// nonceSet remembers the most recently seen nonces,
+// evicting the oldest once maxSeenNonces is reached.
+type nonceSet struct {
+	seen map[[NonceSize]byte]struct{}
+	ring [][NonceSize]byte
+	next int
+}
+
+// add records nonce and reports whether it was not seen before.
+func (s *nonceSet) add(nonce *[NonceSize]byte) bool {
+	if s.seen == nil {
+		s.seen = make(map[[NonceSize]byte]struct{})
+	}
+	if _, ok := s.seen[*nonce]; ok {
+		return false
+	}
+	if len(s.ring) < maxSeenNonces {
+		s.ring = append(s.ring, *nonce)
+	} else {
+		delete(s.seen, s.ring[s.next])
+		s.ring[s.next] = *nonce
+		s.next = (s.next + 1) % maxSeenNonces
+	}
+	s.seen[*nonce] = struct{}{}
+	return true
+}
+
+// reset forgets all nonces, keeping the allocated space.
+func (s *nonceSet) reset() {
+	for n := range s.seen {
+		delete(s.seen, n)
+	}
+	s.ring = s.ring[:0]
+	s.next = 0
+}
+
+// Reset makes the SecureReader read from r with the keys priv and pub,
+// keeping its limits and scratch buffers. Undelivered plaintext and
+// the nonces seen so far are discarded, the counters zeroed.
+func (sr *sR) Reset(r io.Reader, priv, pub *[KeySize]byte) {
+	sr.r = r
+	sr.priv, sr.peerPub, sr.shared = priv, pub, precompute(priv, pub)
+	sr.buf = nil
+	sr.seen.reset()
+	atomic.StoreUint64(&sr.bytes, 0)
+	atomic.StoreUint64(&sr.frames, 0)
+	atomic.StoreUint64(&sr.failures, 0)
+}
+
+// Read delivers at most len(p) bytes of plaintext. A decrypted frame
+// larger than p is kept and served by subsequent calls. Pings are
+// consumed without returning.
 func (sr *sR) Read(p []byte) (int, error) {
-	bs := make([]byte, len(p)+NonceSize+box.Overhead)
-	n, err := sr.r.Read(bs)
-	if err != nil && err != io.EOF { // TODO timeout
-		return 0, err
-	}
-	//	log.Printf("read %d", n)
-	var nonce [NonceSize]byte
-	copy(nonce[:], bs[:NonceSize])
-	//	log.Printf("nonce: %x", nonce[:])
-	m, ok := box.Open(nil, bs[NonceSize:n], &nonce, sr.peerPub, sr.priv)
-	if !ok {
-		//		log.Printf("%d %t", len(m), m == nil)
-		return 0, fmt.Errorf("failed decrypting message")
+	for len(sr.buf) == 0 {
+		m, err := sr.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		sr.buf = m
 	}
-	copy(p, m)
-	return len(m), nil
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
 }
 
-// NewSecureWriter instantiates a new SecureWriter
-func NewSecureWriter(w io.Writer, priv, pub *[KeySize]byte) io.Writer {
-	return &sW{w, priv, pub}
+// ReadMessage returns the plaintext of the next frame, which is what a
+// single Write of up to the writer's chunk size sealed, whatever the
+// size of the reads. If a Read left part of a frame undelivered,
+// that part is returned instead. The slice is the caller's to keep.
+func (sr *sR) ReadMessage() ([]byte, error) {
+	if len(sr.buf) == 0 {
+		m, err := sr.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		sr.buf = m
+	}
+	m := append([]byte(nil), sr.buf...)
+	sr.buf = nil
+	return m, nil
 }
 
-type sW struct {
-	w       io.Writer
-	priv    *[KeySize]byte
-	peerPub *[KeySize]byte
+// WriteTo writes the decrypted stream to w until EOF,
+// sparing io.Copy a round trip through an intermediate buffer.
+func (sr *sR) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for {
+		if len(sr.buf) > 0 {
+			n, err := w.Write(sr.buf)
+			total += int64(n)
+			short := n < len(sr.buf)
+			sr.buf = sr.buf[n:]
+			if err != nil {
+				return total, err
+			}
+			if short {
+				return total, io.ErrShortWrite
+			}
+		}
+		m, err := sr.readFrame()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		sr.buf = m
+	}
 }
 
-func (sw *sW) Write(p []byte) (int, error) {
-	n, err := genNonce()
-	if err != nil {
-		return 0, err
+// readFrame returns the content of the next data frame, skipping pings.
+func (sr *sR) readFrame() ([]byte, error) {
+	for {
+		typ, m, err := sr.readAnyFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case frameData:
+			if sr.gzip {
+				if m, err = gunzip(m, sr.max); err != nil {
+					return nil, err
+				}
+			}
+			atomic.AddUint64(&sr.bytes, uint64(len(m)))
+			return m, nil
+		case framePing:
+			// keep reading
+		default:
+			return nil, fmt.Errorf("%w %d", ErrFrameType, typ)
+		}
 	}
-	out := box.Seal(n[:], p, n, sw.peerPub, sw.priv)
-	//	log.Printf("SW: %d %x", len(out), out)
-	return sw.w.Write(out)
 }
 
-// Dial generates a private/public key pair,
-// connects to the server, perform the handshake
-// and return a reader/writer.
-func Dial(addr string) (io.ReadWriteCloser, error) {
-	pub, priv, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		return nil, err
+// readAnyFrame reads one length prefixed frame and returns its type and
+// decrypted content. The stream ending between frames is io.EOF,
+// within a frame io.ErrUnexpectedEOF.
+func (sr *sR) readAnyFrame() (byte, []byte, error) {
+	var l [LenSize]byte
+	if _, err := io.ReadFull(sr.r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	min := uint32(NonceSize + box.Overhead + 1)
+	if sr.forward {
+		min += KeySize
+	}
+	if size < min {
+		return 0, nil, fmt.Errorf("%w: frame of %d bytes", ErrPartialRead, size)
+	}
+	if int64(size-min) > int64(sr.max) {
+		return 0, nil, fmt.Errorf("%w: %d bytes exceed %d", ErrTooLarge, size-min, sr.max)
+	}
+	if cap(sr.frame) < int(size) {
+		sr.frame = make([]byte, size)
+	}
+	bs := sr.frame[:size]
+	if _, err := io.ReadFull(sr.r, bs); err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, nil, err
+	}
+	peerPub := sr.peerPub
+	if sr.forward {
+		copy(sr.ephPub[:], bs[:KeySize])
+		peerPub = &sr.ephPub
+		bs = bs[KeySize:]
+	}
+	copy(sr.nonce[:], bs[:NonceSize])
+	var m []byte
+	var ok bool
+	if sr.shared != nil {
+		m, ok = box.OpenAfterPrecomputation(sr.plain[:0], bs[NonceSize:], &sr.nonce, sr.shared)
+	} else {
+		m, ok = box.Open(sr.plain[:0], bs[NonceSize:], &sr.nonce, peerPub, sr.priv)
+	}
+	if !ok {
+		atomic.AddUint64(&sr.failures, 1)
+		if l := logger(); l != nil {
+			l.Printf("decrypt failure: frame of %d bytes, nonce %x", size, sr.nonce[:])
+		}
+		return 0, nil, ErrDecryptFailed
+	}
+	if l := logger(); l != nil {
+		l.Printf("read frame of %d bytes", size)
 	}
-	conn, err := net.Dial("tcp", addr)
+	sr.plain = m
+	// only authentic frames are remembered, so forgeries cannot evict nonces
+	if !sr.seen.add(&sr.nonce) {
+		return 0, nil, fmt.Errorf("%w %x", ErrReplay, sr.nonce[:])
+	}
+	atomic.AddUint64(&sr.frames, 1)
+	return m[0], m[1:], nil
+}
+
+// gunzip inflates m, failing if it grows beyond max bytes.
+func gunzip(m []byte, max int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(m))
 	if err != nil {
 		return nil, err
 	}
-	// perform handshake - (pub) key exchange with peer
-	n, err := conn.Write(pub[:])
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
 	if err != nil {
 		return nil, err
 	}
-	if n != KeySize {
-		return nil, fmt.Errorf("partial write")
+	if len(out) > max {
+		return nil, fmt.Errorf("%w: inflates beyond %d bytes", ErrTooLarge, max)
 	}
-	peerPub := new([KeySize]byte)
-	n, err = conn.Read(peerPub[:])
-	if err != nil {
+	return out, nil
+}
+
+func gzipped(p []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(p); err != nil {
 		return nil, err
 	}
-	if n != KeySize {
-		return nil, fmt.Errorf("partial read")
+	if err := zw.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	// write encrypts message using peers pub
-	// read decrypts message using own priv
-	return &sRWC{
-		NewSecureReader(conn, priv, peerPub),
-		NewSecureWriter(conn, priv, peerPub),
-		conn,
-	}, nil
+// MessageWriter is implemented by every SecureWriter, writing strings
+// and single frame messages, see WriteMessage of SecureConn.
+type MessageWriter interface {
+	io.Writer
+	io.StringWriter
+	WriteMessage(p []byte) error
 }
 
-type sRWC struct {
-	io.Reader
+// ResettableWriter is implemented by every SecureWriter, letting a
+// pool reuse it for another stream and keys, see its Reset method.
+type ResettableWriter interface {
 	io.Writer
-	io.Closer
+	Reset(w io.Writer, priv, pub *[KeySize]byte)
 }
 
-// Serve starts a secure echo server on the given listener.
-func Serve(l net.Listener) error {
-	conn, err := l.Accept()
-	if err != nil {
+// NewSecureWriter instantiates a new SecureWriter
+func NewSecureWriter(w io.Writer, priv, pub *[KeySize]byte) io.Writer {
+	return NewSecureWriterRand(w, priv, pub, rand.Reader)
+}
+
+// NewSecureWriterRand instantiates a new SecureWriter
+// reading its nonces from rand instead of crypto/rand.
+func NewSecureWriterRand(w io.Writer, priv, pub *[KeySize]byte, rand io.Reader) io.Writer {
+	return &sW{w: w, priv: priv, peerPub: pub, shared: precompute(priv, pub), rand: rand}
+}
+
+// NewSecureWriterChunk instantiates a new SecureWriter sealing
+// each Write in frames of at most chunk bytes of it.
+func NewSecureWriterChunk(w io.Writer, priv, pub *[KeySize]byte, chunk int) io.Writer {
+	return &sW{w: w, priv: priv, peerPub: pub, shared: precompute(priv, pub), rand: rand.Reader, chunk: chunk}
+}
+
+// NewForwardSecureWriter instantiates a SecureWriter sealing every
+// message to the peer's public key pub with a fresh ephemeral key pair,
+// whose public key is sent ahead of the nonce. The ephemeral private
+// key is discarded right after sealing, so compromising the sender
+// exposes no past messages. This is only half of forward secrecy:
+// the peer's private key opens every message ever sealed to pub, so
+// its compromise exposes all of them. Neither does the peer learn who
+// sent a message, the frames carry no sender identity.
+func NewForwardSecureWriter(w io.Writer, pub *[KeySize]byte) io.Writer {
+	return &sW{w: w, peerPub: pub, rand: rand.Reader, forward: true}
+}
+
+// NewSecureWriterGzip instantiates a SecureWriter gzipping every
+// message before sealing it. Compression happens ahead of encryption,
+// so the ciphertext still looks random.
+func NewSecureWriterGzip(w io.Writer, priv, pub *[KeySize]byte) io.Writer {
+	return &sW{w: w, priv: priv, peerPub: pub, shared: precompute(priv, pub), rand: rand.Reader, gzip: true}
+}
+
+// NewSecureWriterCounter instantiates a SecureWriter deriving its
+// nonces from a 64-bit counter in the low 8 bytes, below a random
+// 16 byte prefix chosen on the first Write. Unlike random nonces,
+// this makes reuse impossible for the lifetime of the writer.
+// Any SecureReader reads its frames.
+func NewSecureWriterCounter(w io.Writer, priv, pub *[KeySize]byte) io.Writer {
+	return &sW{w: w, priv: priv, peerPub: pub, shared: precompute(priv, pub), rand: rand.Reader, counter: true}
+}
+
+type sW struct {
+	// counters first for 64-bit alignment of atomic access
+	bytes, frames uint64
+
+	w       io.Writer
+	priv    *[KeySize]byte
+	peerPub *[KeySize]byte
+	shared  *[KeySize]byte // precomputed key used instead of priv and peerPub
+	rand    io.Reader
+	chunk   int  // largest part of a Write sealed into one frame, 0 for the default
+	forward bool // seal each message with an ephemeral key pair
+	gzip    bool // gzip each message before sealing
+	counter bool // derive nonces from prefix and seq
+	prefix  bool // whether the nonce prefix was chosen
+	seq     uint64
+
+	// scratch space reused by every Write
+	nonce [NonceSize]byte
+	plain []byte // frame type and message
+	out   []byte
+	in    []byte // chunks read by ReadFrom
+}
+
+// Reset makes the SecureWriter write to w with the keys priv and pub,
+// keeping its settings and scratch buffers. A counter writer chooses
+// a new nonce prefix and restarts its count. The counters are zeroed.
+func (sw *sW) Reset(w io.Writer, priv, pub *[KeySize]byte) {
+	sw.w = w
+	sw.priv, sw.peerPub, sw.shared = priv, pub, precompute(priv, pub)
+	sw.prefix = false
+	sw.seq = 0
+	atomic.StoreUint64(&sw.bytes, 0)
+	atomic.StoreUint64(&sw.frames, 0)
+}
+
+// chunkSize returns the largest part of a Write sealed into a single
+// frame, so a reader can start on a large write before all of it
+// arrived and later small writes are not stuck behind it.
+func (sw *sW) chunkSize() int {
+	if sw.chunk > 0 {
+		return sw.chunk
+	}
+	return DefaultChunkSize
+}
+
+// Write seals p into frames of at most chunkSize bytes of p each:
+// the big-endian length of the rest of the frame, followed by
+// the nonce and the sealed box of a frame type byte and the message.
+// A forward secure frame has the ephemeral public key ahead of the
+// nonce. An empty p is sealed into an empty frame.
+func (sw *sW) Write(p []byte) (int, error) {
+	var n int
+	for first := true; first || len(p) > 0; first = false {
+		chunk := p
+		if len(chunk) > sw.chunkSize() {
+			chunk = chunk[:sw.chunkSize()]
+		}
+		if err := sw.writeFrame(frameData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// WriteString is like Write for the bytes of s.
+func (sw *sW) WriteString(s string) (int, error) {
+	return sw.Write([]byte(s))
+}
+
+// WriteMessage seals p into exactly one frame whatever the chunk size,
+// which a single ReadMessage on the other end returns whole.
+// The reader still rejects messages beyond its maximum size.
+func (sw *sW) WriteMessage(p []byte) error {
+	return sw.writeFrame(frameData, p)
+}
+
+// Flush flushes the underlying writer if it buffers, i.e. has a
+// Flush method. The SecureWriter itself keeps nothing back,
+// every Write is sealed and written right away.
+func (sw *sW) Flush() error {
+	if f, ok := sw.w.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// WritePing seals an empty heartbeat frame, which the reader
+// consumes without passing it on to the application.
+func (sw *sW) WritePing() error {
+	return sw.writeFrame(framePing, nil)
+}
+
+// ReadFrom seals what it reads from r until EOF, a frame for each
+// read of up to chunkSize bytes, sparing io.Copy an intermediate buffer.
+func (sw *sW) ReadFrom(r io.Reader) (int64, error) {
+	if sw.in == nil {
+		sw.in = make([]byte, sw.chunkSize())
+	}
+	var total int64
+	for {
+		n, err := r.Read(sw.in)
+		if n > 0 {
+			if werr := sw.writeFrame(frameData, sw.in[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// writeFrame seals p into a single frame of type typ.
+func (sw *sW) writeFrame(typ byte, p []byte) error {
+	m := p
+	if sw.gzip && typ == frameData {
+		var err error
+		if m, err = gzipped(p); err != nil {
+			return err
+		}
+	}
+	sw.plain = append(append(sw.plain[:0], typ), m...)
+	m = sw.plain
+	if need := LenSize + KeySize + NonceSize + len(m) + box.Overhead; cap(sw.out) < need {
+		sw.out = make([]byte, 0, need)
+	}
+	out := sw.out[:LenSize]
+	priv := sw.priv
+	if sw.forward {
+		pub, ephPriv, err := box.GenerateKey(sw.rand)
+		if err != nil {
+			return err
+		}
+		priv = ephPriv
+		out = append(out, pub[:]...)
+	}
+	if err := sw.nextNonce(); err != nil {
 		return err
 	}
-	defer conn.Close()
-	peerPub := new([KeySize]byte)
-	n, err := conn.Read(peerPub[:])
-	if err != nil {
+	out = append(out, sw.nonce[:]...)
+	if sw.shared != nil {
+		out = box.SealAfterPrecomputation(out, m, &sw.nonce, sw.shared)
+	} else {
+		out = box.Seal(out, m, &sw.nonce, sw.peerPub, priv)
+	}
+	binary.BigEndian.PutUint32(out, uint32(len(out)-LenSize))
+	if _, err := sw.w.Write(out); err != nil {
 		return err
 	}
-	if n != KeySize {
-		return fmt.Errorf("illegal key size")
+	atomic.AddUint64(&sw.frames, 1)
+	if typ == frameData {
+		atomic.AddUint64(&sw.bytes, uint64(len(p)))
+	}
+	if l := logger(); l != nil {
+		l.Printf("wrote frame of %d bytes", len(out)-LenSize)
 	}
+	return nil
+}
 
-	pub, priv, err := box.GenerateKey(rand.Reader)
-	if err != nil {
-		return err
+// nextNonce sets sw.nonce for the next message.
+func (sw *sW) nextNonce() error {
+	if !sw.counter {
+		return genNonce(sw.rand, &sw.nonce)
+	}
+	if !sw.prefix {
+		if _, err := io.ReadFull(sw.rand, sw.nonce[:NonceSize-8]); err != nil {
+			return err
+		}
+		sw.prefix = true
+	} else if sw.seq == 0 {
+		return errors.New("nonce counter exhausted")
 	}
+	binary.BigEndian.PutUint64(sw.nonce[NonceSize-8:], sw.seq)
+	sw.seq++
+	return nil
+}
 
-	n, err = conn.Write(pub[:])
-	if err != nil {
-		return err
+// DefaultHandshakeTimeout bounds the key exchange of connections
+// without a HandshakeTimeout option.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Dial generates a private/public key pair,
+// connects to the server, perform the handshake
+// and return the secured connection.
+// addr is a TCP address like "localhost:4000" or "[::1]:4000",
+// see net.JoinHostPort, or a unix socket path prefixed by "unix:".
+func Dial(addr string, opts ...Option) (*SecureConn, error) {
+	return DialContext(context.Background(), addr, opts...)
+}
+
+// DialContext is like Dial but uses ctx to bound both the
+// connect and the handshake. If ctx is done before the
+// handshake completes, the connection is closed and ctx.Err()
+// is returned.
+func DialContext(ctx context.Context, addr string, opts ...Option) (*SecureConn, error) {
+	return dial(ctx, new(net.Dialer), addr, nil, newOptions(opts))
+}
+
+// DialFrom is like Dial but connects from localAddr, e.g. to pick the
+// interface of a multi-homed host. localAddr is an address of the
+// network of remoteAddr, like "192.168.1.2:0" for TCP. opts apply like
+// for Dial.
+func DialFrom(localAddr, remoteAddr string, opts ...Option) (*SecureConn, error) {
+	var local net.Addr
+	var err error
+	if nw, _ := network(remoteAddr); nw == "unix" {
+		local, err = net.ResolveUnixAddr(nw, localAddr)
+	} else {
+		local, err = net.ResolveTCPAddr(nw, localAddr)
 	}
-	if n != KeySize {
-		return fmt.Errorf("partial pub key write")
+	if err != nil {
+		return nil, err
 	}
+	return dial(context.Background(), &net.Dialer{LocalAddr: local}, remoteAddr, nil, newOptions(opts))
+}
 
-	r := NewSecureReader(conn, priv, peerPub)
-	w := NewSecureWriter(conn, priv, peerPub)
+// DialAuthenticated is like Dial but fails if the server does not
+// present serverPub during the handshake, so no data is ever sent
+// to an impostor. opts apply like for Dial.
+func DialAuthenticated(addr string, serverPub *[KeySize]byte, opts ...Option) (*SecureConn, error) {
+	return dial(context.Background(), new(net.Dialer), addr, serverPub, newOptions(opts))
+}
 
-	bufSize := 1 << 15 // 32k
-	buf := make([]byte, bufSize, bufSize)
+// dial connects to addr with d and performs the handshake. A non-nil
+// serverPub pins the public key the server must present.
+func dial(ctx context.Context, d *net.Dialer, addr string, serverPub *[KeySize]byte, o options) (*SecureConn, error) {
+	nw, address := network(addr)
+	conn, err := d.DialContext(ctx, nw, address)
+	if err != nil {
+		return nil, err
+	}
+	o.setup(conn)
 
-	n, err = r.Read(buf)
+	o.startHandshake(conn)
+	// unblock the handshake once ctx is done
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	priv, peerPub, err := Handshake(conn)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if serverPub != nil && *serverPub != *peerPub {
+		conn.Close()
+		return nil, fmt.Errorf("%w: got %x", ErrKeyMismatch, peerPub[:])
 	}
-	_, err = w.Write(buf[:n])
+
+	sc, err := newSecureConn(conn, priv, peerPub, true)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
+	sc.Writer.(*sW).chunk = o.bufSize
+	return sc, nil
+}
 
-	return nil
+// network splits addr into the network and the address
+// to use with it, which is TCP unless addr has a "unix:" prefix.
+func network(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
 }
 
 func main() {
@@ -173,29 +720,34 @@ func main() {
 
 	// Server mode
 	if *port != 0 {
-		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer l.Close()
-		log.Fatal(Serve(l))
+		log.Fatal(ListenAndServe(fmt.Sprintf(":%d", *port)))
 	}
 
 	// Client mode
 	if len(os.Args) != 3 {
 		log.Fatalf("Usage: %s <port> <message>", os.Args[0])
 	}
-	conn, err := Dial("localhost:" + os.Args[1])
-	if err != nil {
+	if err := client(net.JoinHostPort("localhost", os.Args[1]), os.Args[2], os.Stdout); err != nil {
 		log.Fatal(err)
 	}
-	if _, err := conn.Write([]byte(os.Args[2])); err != nil {
-		log.Fatal(err)
+}
+
+// client sends msg to the echo server at addr and writes the echo
+// to w, followed by a newline. It reads until it got as many bytes
+// as it sent, however many frames and reads they take, or until the
+// server closes the connection.
+func client(addr, msg string, w io.Writer) error {
+	conn, err := Dial(addr)
+	if err != nil {
+		return err
 	}
-	buf := make([]byte, len(os.Args[2]))
-	n, err := conn.Read(buf)
-	if err != nil && err != io.EOF {
-		log.Fatal(err)
+	defer conn.Close()
+	if _, err := io.WriteString(conn, msg); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, conn, int64(len(msg))); err != nil && err != io.EOF {
+		return err
 	}
-	fmt.Printf("%s\n", buf[:n])
+	_, err = fmt.Fprintln(w)
+	return err
 }
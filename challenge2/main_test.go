@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
 )
 
 func TestReadWriterPing(t *testing.T) {
@@ -159,7 +175,7 @@ func TestSecureDial(t *testing.T) {
 			}
 			go func(c net.Conn) {
 				defer c.Close()
-				key := [32]byte{}
+				key := [1 + 32]byte{ProtocolVersion, 'k', 'e', 'y'}
 				c.Write(key[:])
 				buf := make([]byte, 2048)
 				n, err := c.Read(buf)
@@ -184,3 +200,943 @@ func TestSecureDial(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReadWriterLargePayload(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	secureR := NewSecureReader(c1, priv, pub)
+	secureW := NewSecureWriter(c2, priv, pub)
+
+	expected := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1MB
+	go func() {
+		if _, err := secureW.Write(expected); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	got := make([]byte, 0, len(expected))
+	buf := make([]byte, 512)
+	for len(got) < len(expected) {
+		n, err := secureR.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result: got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestReadSmallBuffer(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	r, w := io.Pipe()
+	secureR := NewSecureReader(r, priv, pub)
+	secureW := NewSecureWriter(w, priv, pub)
+
+	expected := bytes.Repeat([]byte("0123456789"), 10)
+	go func() {
+		secureW.Write(expected)
+		w.Close()
+	}()
+
+	var got []byte
+	buf := make([]byte, 10)
+	for {
+		n, err := secureR.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(buf) {
+			t.Fatalf("Unexpected read size: %d != %d", n, len(buf))
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result: %s != %s", got, expected)
+	}
+}
+
+func TestSecureEchoServerMultipleMessages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, expected := range []string{"hello world\n", "second message\n", "third\n"} {
+		if _, err := fmt.Fprint(conn, expected); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); got != expected {
+			t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+		}
+	}
+}
+
+func TestSecureEchoServerConcurrentClients(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		conn, err := Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		wg.Add(1)
+		go func(i int, conn io.ReadWriter) {
+			defer wg.Done()
+			expected := fmt.Sprintf("hello from client %d\n", i)
+			if _, err := fmt.Fprint(conn, expected); err != nil {
+				t.Error(err)
+				return
+			}
+			buf := make([]byte, len(expected))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if got := string(buf); got != expected {
+				t.Errorf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+}
+
+func TestDialContextHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// accept but never answer the handshake
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	conn, err := DialContext(ctx, l.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result: handshake with a silent server succeeded")
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v != %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// accept but never answer the handshake
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	conn, err := Dial(l.Addr().String(), HandshakeTimeout(50*time.Millisecond))
+	if err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result: handshake with a silent server succeeded")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Unexpected error: %v, expected a timeout", err)
+	}
+}
+
+func TestSecureConnReadDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_, err = conn.Read(buf)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Unexpected error: %v, expected a timeout", err)
+	}
+}
+
+func TestDialAuthenticatedMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	pinned := &[32]byte{'n', 'o', 't', ' ', 't', 'h', 'e', ' ', 's', 'e', 'r', 'v', 'e', 'r'}
+	conn, err := DialAuthenticated(l.Addr().String(), pinned)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Unexpected result: dial succeeded with a mismatched server key")
+	}
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrKeyMismatch)
+	}
+}
+
+func TestSecureReaderRejectsReplay(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	frame := new(bytes.Buffer)
+	if _, err := fmt.Fprintf(NewSecureWriter(frame, priv, pub), "hello world\n"); err != nil {
+		t.Fatal(err)
+	}
+	// the same sealed frame twice
+	wire := bytes.NewReader(append(frame.Bytes(), frame.Bytes()...))
+	secureR := NewSecureReader(wire, priv, pub)
+
+	buf := make([]byte, 1024)
+	n, err := secureR.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(buf[:n]); res != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
+	}
+	if _, err := secureR.Read(buf); err == nil {
+		t.Fatal("Unexpected result: replayed frame was accepted")
+	}
+}
+
+func TestSecureWriterRand(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	seal := func() []byte {
+		buf := new(bytes.Buffer)
+		w := NewSecureWriterRand(buf, priv, pub, rand.New(rand.NewSource(42)))
+		if _, err := fmt.Fprintf(w, "hello world\n"); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	// Same seed, same nonce, same ciphertext
+	if b1, b2 := seal(), seal(); !bytes.Equal(b1, b2) {
+		t.Fatalf("Unexpected result: %x != %x", b1, b2)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestListenAndServe(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	errc := make(chan error, 1)
+	go func() { errc <- ListenAndServe("127.0.0.1:0") }()
+
+	// discover the bound address from the log
+	re := regexp.MustCompile(`listening on (\S+)`)
+	var addr string
+	for deadline := time.Now().Add(time.Second); addr == ""; {
+		select {
+		case err := <-errc:
+			t.Fatal(err)
+		default:
+		}
+		if m := re.FindStringSubmatch(logs.String()); m != nil {
+			addr = m[1]
+		} else if time.Now().After(deadline) {
+			t.Fatal("Unexpected result: bound address was not logged")
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	conn, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestSecureReaderErrors(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	sealed := new(bytes.Buffer)
+	fmt.Fprintf(NewSecureWriter(sealed, priv, pub), "hello world\n")
+
+	tData := []struct {
+		name string
+		wire []byte
+		priv *[32]byte
+		err  error
+	}{
+		{"short frame", []byte{0, 0, 0, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, priv, ErrPartialRead},
+		{"wrong key", sealed.Bytes(), &[32]byte{'o', 't', 'h', 'e', 'r'}, ErrDecryptFailed},
+	}
+	for _, exp := range tData {
+		r := NewSecureReader(bytes.NewReader(exp.wire), exp.priv, pub)
+		_, err := r.Read(make([]byte, 1024))
+		if !errors.Is(err, exp.err) {
+			t.Fatalf("%s: unexpected error: %v, expected %v", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestSecureReaderEOF(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	sealed := new(bytes.Buffer)
+	fmt.Fprintf(NewSecureWriter(sealed, priv, pub), "hello world\n")
+	frame := sealed.Bytes()
+
+	tData := []struct {
+		name string
+		wire []byte
+		err  error
+	}{
+		{"frame boundary", frame, io.EOF},
+		{"within length", append(frame[:len(frame):len(frame)], 0, 0), io.ErrUnexpectedEOF},
+		{"after length", append(frame[:len(frame):len(frame)], frame[:LenSize]...), io.ErrUnexpectedEOF},
+		{"within frame", append(frame[:len(frame):len(frame)], frame[:len(frame)-1]...), io.ErrUnexpectedEOF},
+	}
+	for _, exp := range tData {
+		r := NewSecureReader(bytes.NewReader(exp.wire), priv, pub)
+		buf := make([]byte, 1024)
+		if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello world\n" {
+			t.Fatalf("%s: unexpected result: %q, %v", exp.name, buf[:n], err)
+		}
+		if _, err := r.Read(buf); err != exp.err {
+			t.Fatalf("%s: unexpected error: %v, expected %v", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestSecureReaderReset(t *testing.T) {
+	priv1, pub1 := &[32]byte{'p', 'r', 'i', 'v', '1'}, &[32]byte{'p', 'u', 'b', '1'}
+	priv2, pub2 := &[32]byte{'p', 'r', 'i', 'v', '2'}, &[32]byte{'p', 'u', 'b', '2'}
+
+	// both streams use the same nonces, which must not count as replays
+	wire1, wire2 := new(bytes.Buffer), new(bytes.Buffer)
+	fmt.Fprint(NewSecureWriterRand(wire1, priv1, pub1, rand.New(rand.NewSource(42))), "hello world\n")
+	w := NewSecureWriterRand(wire2, priv1, pub1, rand.New(rand.NewSource(42)))
+	w.(ResettableWriter).Reset(wire2, priv2, pub2)
+	fmt.Fprint(w, "hello again\n")
+
+	r := NewSecureReader(wire1, priv1, pub1)
+	buf := make([]byte, 5)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Unexpected result: %q, %v", buf[:n], err)
+	}
+	// the rest of the first message is dropped
+	r.(ResettableReader).Reset(wire2, priv2, pub2)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello again\n" {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+}
+
+func TestSecureWriterPing(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	w := NewSecureWriter(wire, priv, pub)
+	pinger := w.(interface{ WritePing() error })
+	for _, m := range []string{"", "hello ", "", "", "world\n", ""} {
+		var err error
+		if m == "" {
+			err = pinger.WritePing()
+		} else {
+			_, err = fmt.Fprint(w, m)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewSecureReader(wire, priv, pub)
+	buf := make([]byte, 1024)
+	var got []string
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			t.Fatal("Unexpected result: empty read")
+		}
+		got = append(got, string(buf[:n]))
+	}
+	if expected := []string{"hello ", "world\n"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected result: %q != %q", got, expected)
+	}
+}
+
+func TestSecureReaderReadMessage(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	messages := []string{"hello world\n", strings.Repeat("a long one ", 1000), "bye"}
+	wire := new(bytes.Buffer)
+	w := NewSecureWriter(wire, priv, pub)
+	for _, m := range messages {
+		if _, err := io.WriteString(w, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewSecureReader(wire, priv, pub).(MessageReader)
+	for _, expected := range messages {
+		m, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != expected {
+			t.Fatalf("Unexpected result: %q != %q", m, expected)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Fatalf("Unexpected error: %v, expected %v", err, io.EOF)
+	}
+}
+
+func TestSecureWriterWriteMessage(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// messages beyond the chunk size still go in one frame
+	messages := []string{"hello world\n", "", strings.Repeat("x", 100)}
+	wire := new(bytes.Buffer)
+	w := NewSecureWriterChunk(wire, priv, pub, 16).(MessageWriter)
+	for _, m := range messages {
+		if err := w.WriteMessage([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewSecureReader(wire, priv, pub).(MessageReader)
+	for _, expected := range messages {
+		m, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != expected {
+			t.Fatalf("Unexpected result: %q != %q", m, expected)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Fatalf("Unexpected error: %v, expected %v", err, io.EOF)
+	}
+}
+
+func TestSecureWriterWriteString(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	w := NewSecureWriter(wire, priv, pub)
+	if _, ok := w.(io.StringWriter); !ok {
+		t.Fatalf("Unexpected result: %T is not an io.StringWriter", w)
+	}
+	if n, err := io.WriteString(w, "hello world\n"); err != nil || n != 12 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	got, err := ioutil.ReadAll(NewSecureReader(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world\n" {
+		t.Fatalf("Unexpected result: %q", got)
+	}
+}
+
+func TestForwardSecureReadWriter(t *testing.T) {
+	pub, priv, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wire := new(bytes.Buffer)
+	secureW := NewForwardSecureWriter(wire, pub)
+	for _, m := range []string{"hello world\n", "hello again\n"} {
+		if _, err := fmt.Fprint(secureW, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Make sure each message uses its own ephemeral key
+	frames := wire.Bytes()
+	frameLen := LenSize + int(binary.BigEndian.Uint32(frames))
+	if eph1, eph2 := frames[LenSize:LenSize+KeySize], frames[frameLen+LenSize:frameLen+LenSize+KeySize]; bytes.Equal(eph1, eph2) {
+		t.Fatalf("Unexpected result. Ephemeral key %x was reused", eph1)
+	}
+
+	secureR := NewForwardSecureReader(wire, priv)
+	buf := make([]byte, 12)
+	for _, expected := range []string{"hello world\n", "hello again\n"} {
+		if _, err := io.ReadFull(secureR, buf); err != nil {
+			t.Fatal(err)
+		}
+		if res := string(buf); res != expected {
+			t.Fatalf("Unexpected result: %s != %s", res, expected)
+		}
+	}
+}
+
+func TestGzipReadWriter(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriterGzip(wire, priv, pub)
+	expected := bytes.Repeat([]byte("hello world\n"), 64<<10/12)
+	// an empty message must not disturb the stream
+	if _, err := secureW.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secureW.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	if wire.Len() > len(expected)/10 {
+		t.Fatalf("Unexpected result: %d wire bytes for %d bytes of plaintext", wire.Len(), len(expected))
+	}
+
+	got, err := ioutil.ReadAll(NewSecureReaderGzip(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result: got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestSecureReaderMaxMessageSize(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// a frame claiming 4G without any content behind it
+	wire := bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})
+	_, err := NewSecureReader(wire, priv, pub).Read(make([]byte, 1024))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrTooLarge)
+	}
+
+	sealed := new(bytes.Buffer)
+	fmt.Fprintf(NewSecureWriter(sealed, priv, pub), "hello world\n")
+	_, err = NewSecureReaderSize(sealed, priv, pub, 8).Read(make([]byte, 1024))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrTooLarge)
+	}
+}
+
+func TestSecureReaderWriteTo(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriter(wire, priv, pub)
+	expected := new(bytes.Buffer)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(io.MultiWriter(secureW, expected), "hello world %d\n", i)
+	}
+
+	got := new(bytes.Buffer)
+	n, err := io.Copy(got, NewSecureReader(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(expected.Len()) || got.String() != expected.String() {
+		t.Fatalf("Unexpected result: %d bytes\n%s\nexpected %d bytes\n%s", n, got, expected.Len(), expected)
+	}
+}
+
+// shortWriter writes at most max bytes of each Write without an error.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSecureReaderWriteToShortWrite(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriter(wire, priv, pub)
+	expected := "hello world 0\nhello world 1\n"
+	fmt.Fprint(secureW, expected[:14])
+	fmt.Fprint(secureW, expected[14:])
+
+	r := NewSecureReader(wire, priv, pub).(io.WriterTo)
+	w := &shortWriter{max: 5}
+	if n, err := r.WriteTo(w); err != io.ErrShortWrite || n != 5 {
+		t.Fatalf("Unexpected result: %d, %v, expected 5, %v", n, err, io.ErrShortWrite)
+	}
+	// nothing unwritten is lost
+	rest, err := ioutil.ReadAll(r.(io.Reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String() + string(rest); got != expected {
+		t.Fatalf("Unexpected result: %q, expected %q", got, expected)
+	}
+}
+
+func benchmarkCopy(b *testing.B, wrap func(io.Reader) io.Reader) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriter(wire, priv, pub)
+	msg := bytes.Repeat([]byte{'x'}, 64<<10)
+	for i := 0; i < 16; i++ {
+		secureW.Write(msg)
+	}
+	b.SetBytes(int64(16 * len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewSecureReader(bytes.NewReader(wire.Bytes()), priv, pub)
+		if _, err := io.Copy(ioutil.Discard, wrap(r)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyWriteTo(b *testing.B) {
+	benchmarkCopy(b, func(r io.Reader) io.Reader { return r })
+}
+
+func BenchmarkCopyRead(b *testing.B) {
+	// hide WriteTo from io.Copy
+	benchmarkCopy(b, func(r io.Reader) io.Reader { return struct{ io.Reader }{r} })
+}
+
+func benchmarkCopyInto(b *testing.B, wrap func(io.Writer) io.Writer) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	msg := bytes.Repeat([]byte{'x'}, 1<<20)
+	secureW := NewSecureWriter(ioutil.Discard, priv, pub)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// hide WriterTo from io.Copy
+		r := struct{ io.Reader }{bytes.NewReader(msg)}
+		if _, err := io.Copy(wrap(secureW), r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyReadFrom(b *testing.B) {
+	benchmarkCopyInto(b, func(w io.Writer) io.Writer { return w })
+}
+
+func BenchmarkCopyWrite(b *testing.B) {
+	// hide ReadFrom from io.Copy
+	benchmarkCopyInto(b, func(w io.Writer) io.Writer { return struct{ io.Writer }{w} })
+}
+
+func TestSecureWriterReadFrom(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	expected := bytes.Repeat([]byte("0123456789abcdef"), 1<<12) // 64K
+	n, err := io.Copy(NewSecureWriter(wire, priv, pub), bytes.NewBuffer(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(expected)) {
+		t.Fatalf("Unexpected result: copied %d bytes, expected %d", n, len(expected))
+	}
+	got, err := ioutil.ReadAll(NewSecureReader(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result: got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestSecureConnCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the last part is still buffered when closing
+	bw := bufio.NewWriter(conn.Writer)
+	conn.Writer = bw
+	expected := "request part 1\nrequest part 2\n"
+	fmt.Fprint(conn, expected[:15])
+	bw.Flush()
+	fmt.Fprint(conn, expected[15:])
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server sees EOF, replies and closes
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+// BenchmarkReadWriteSmall measures a 64 byte round trip. With the shared
+// key precomputed by the constructors it takes 1 alloc/op (5 B/op, about
+// 1.2µs/op), down from 15 allocs/op (760 B/op, about 180µs/op) when every
+// frame repeated the key agreement.
+func BenchmarkReadWriteSmall(b *testing.B) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriter(wire, priv, pub)
+	secureR := NewSecureReader(wire, priv, pub)
+	msg := bytes.Repeat([]byte{'x'}, 64)
+	buf := make([]byte, len(msg))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		if _, err := secureW.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(secureR, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSecureWriterCounter(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	// The reader copes with counter nonces
+	wire := new(bytes.Buffer)
+	secureW := NewSecureWriterCounter(wire, priv, pub)
+	fmt.Fprint(secureW, "hello ")
+	fmt.Fprint(secureW, "world\n")
+	got, err := ioutil.ReadAll(NewSecureReader(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := string(got); res != "hello world\n" {
+		t.Fatalf("Unexpected result: %s != %s", res, "hello world")
+	}
+
+	// Without sealing, generate nonces for a million messages
+	sw := secureW.(*sW)
+	seen := make(map[[NonceSize]byte]bool, 1000000)
+	for i := 0; i < 1000000; i++ {
+		if err := sw.nextNonce(); err != nil {
+			t.Fatal(err)
+		}
+		if seen[sw.nonce] {
+			t.Fatalf("Unexpected result: nonce %x repeated after %d messages", sw.nonce, i)
+		}
+		seen[sw.nonce] = true
+	}
+}
+
+func TestSecureWriterFirstChunk(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	secureR := NewSecureReader(c1, priv, pub)
+	secureW := NewSecureWriter(c2, priv, pub)
+
+	// the reader gets the start of a large write before its end was sealed
+	go secureW.Write(make([]byte, 1<<20))
+	n, err := secureR.Read(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > DefaultChunkSize {
+		t.Fatalf("Unexpected result: first read of %d bytes, expected at most %d", n, DefaultChunkSize)
+	}
+}
+
+// pipeListener hands out the server ends of net.Pipe connections.
+type pipeListener chan net.Conn
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l
+	if !ok {
+		return nil, errors.New("listener closed")
+	}
+	return c, nil
+}
+
+func (l pipeListener) Close() error   { close(l); return nil }
+func (l pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func BenchmarkSecureThroughput(b *testing.B) {
+	l := make(pipeListener)
+	defer l.Close()
+	go Serve(l)
+
+	c1, c2 := net.Pipe()
+	l <- c2
+	priv, peerPub, err := Handshake(c1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn, err := newSecureConn(c1, priv, peerPub, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := make([]byte, 10<<20) // 10M
+	buf := make([]byte, len(msg))
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go conn.Write(msg)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSecureWriterChunk(t *testing.T) {
+	priv, pub := &[32]byte{'p', 'r', 'i', 'v'}, &[32]byte{'p', 'u', 'b'}
+
+	wire := new(bytes.Buffer)
+	expected := bytes.Repeat([]byte("0123456789abcdef"), 100<<10/16) // 100K
+	if _, err := NewSecureWriterChunk(wire, priv, pub, 16<<10).Write(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	var frames int
+	for b := wire.Bytes(); len(b) > 0; frames++ {
+		b = b[LenSize+binary.BigEndian.Uint32(b):]
+	}
+	if frames != 7 {
+		t.Fatalf("Unexpected result: %d frames, expected 7", frames)
+	}
+	got, err := ioutil.ReadAll(NewSecureReader(wire, priv, pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Unexpected result: got %d bytes, expected %d", len(got), len(expected))
+	}
+}
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go Serve(l)
+
+	// larger than a TCP segment and than a frame
+	msg := strings.Repeat("hello world ", 10000)
+	out := new(bytes.Buffer)
+	if err := client(l.Addr().String(), msg, out); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := out.String(), msg+"\n"; got != expected {
+		t.Fatalf("Unexpected result: %d bytes, expected %d", len(got), len(expected))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// SealMessage seals plaintext with priv for the peer's public key pub,
+// independent of any connection, e.g. to store it. The result is a
+// random nonce followed by the sealed box, to be opened by OpenMessage.
+func SealMessage(plaintext []byte, priv, pub *[KeySize]byte) ([]byte, error) {
+	var nonce [NonceSize]byte
+	if err := genNonce(rand.Reader, &nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, NonceSize, NonceSize+len(plaintext)+box.Overhead)
+	copy(out, nonce[:])
+	return box.Seal(out, plaintext, &nonce, pub, priv), nil
+}
+
+// OpenMessage opens a message sealed by SealMessage with priv, pub
+// being the public key of the sender.
+func OpenMessage(ciphertext []byte, priv, pub *[KeySize]byte) ([]byte, error) {
+	if len(ciphertext) < NonceSize+box.Overhead {
+		return nil, fmt.Errorf("%w: message of %d bytes", ErrPartialRead, len(ciphertext))
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], ciphertext)
+	m, ok := box.Open(nil, ciphertext[NonceSize:], &nonce, pub, priv)
+	if !ok {
+		return nil, ErrDecryptFailed
+	}
+	return m, nil
+}
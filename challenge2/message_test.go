@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSealOpenMessage(t *testing.T) {
+	senderPub, senderPriv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvPub, recvPriv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"hello world\n", ""} {
+		sealed, err := SealMessage([]byte(expected), senderPriv, recvPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := OpenMessage(sealed, recvPriv, senderPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m) != expected {
+			t.Fatalf("Unexpected result: %q != %q", m, expected)
+		}
+	}
+
+	// nonces are random, the same message never seals the same way
+	a, _ := SealMessage([]byte("hello"), senderPriv, recvPub)
+	b, _ := SealMessage([]byte("hello"), senderPriv, recvPub)
+	if string(a) == string(b) {
+		t.Fatal("Unexpected result: same message sealed twice alike")
+	}
+}
+
+func TestOpenMessageTampered(t *testing.T) {
+	senderPub, senderPriv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvPub, recvPriv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := SealMessage([]byte("hello world\n"), senderPriv, recvPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(i int) []byte {
+		c := append([]byte(nil), sealed...)
+		c[i] ^= 1
+		return c
+	}
+	tData := []struct {
+		name       string
+		ciphertext []byte
+		err        error
+	}{
+		{"nonce", flip(0), ErrDecryptFailed},
+		{"box", flip(len(sealed) - 1), ErrDecryptFailed},
+		{"truncated", sealed[:len(sealed)-1], ErrDecryptFailed},
+		{"too short", sealed[:NonceSize], ErrPartialRead},
+	}
+	for _, exp := range tData {
+		if _, err := OpenMessage(exp.ciphertext, recvPriv, senderPub); !errors.Is(err, exp.err) {
+			t.Fatalf("%s: unexpected error: %v, expected %v", exp.name, err, exp.err)
+		}
+	}
+	otherPub, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMessage(sealed, recvPriv, otherPub); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, ErrDecryptFailed)
+	}
+}
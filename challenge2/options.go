@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Option configures a server or a client connection.
+type Option func(*options)
+
+type options struct {
+	bufSize   int            // largest frame written, 0 for DefaultChunkSize
+	noDelay   *bool          // nil keeps the TCP default
+	handshake *time.Duration // nil for DefaultHandshakeTimeout
+	idle      time.Duration
+}
+
+// WithBufferSize makes the connection write, and the server echo,
+// in frames of at most n bytes, DefaultChunkSize unless set.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.bufSize = n
+	}
+}
+
+// NoDelay sets TCP_NODELAY on TCP connections: true disables Nagle's
+// algorithm, false enables it. Unless set, connections keep the
+// default of package net, which is true.
+func NoDelay(noDelay bool) Option {
+	return func(o *options) {
+		o.noDelay = &noDelay
+	}
+}
+
+// HandshakeTimeout bounds the key exchange of a connection, so a peer
+// stalling the handshake cannot block forever. Zero disables it,
+// connections use DefaultHandshakeTimeout unless set.
+func HandshakeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handshake = &d
+	}
+}
+
+// IdleTimeout makes the server close connections of clients sending
+// nothing for d, reporting ErrIdleTimeout. Every read from the
+// client restarts the timer. Dialed connections ignore it.
+func IdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idle = d
+	}
+}
+
+// setup applies the socket options to a new connection.
+func (o *options) setup(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok && o.noDelay != nil {
+		tc.SetNoDelay(*o.noDelay)
+	}
+}
+
+// startHandshake sets the deadline of conn for the handshake.
+func (o *options) startHandshake(conn net.Conn) {
+	d := DefaultHandshakeTimeout
+	if o.handshake != nil {
+		d = *o.handshake
+	}
+	if d > 0 {
+		conn.SetDeadline(time.Now().Add(d))
+	}
+}
+
+// newOptions applies opts to the defaults.
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DialRetry is like Dial but retries failed dials up to maxRetries
+// times, doubling the pause between attempts starting at backoff.
+// Reads and writes on the returned connection failing with a
+// net.Error re-dial the same way and are retried on the new connection.
+//
+// Every reconnect performs a new handshake, generating fresh keys,
+// so the peer sees a new client. Data in flight when the connection
+// broke is lost; callers need to cope with that at their protocol level.
+func DialRetry(addr string, maxRetries int, backoff time.Duration) (io.ReadWriteCloser, error) {
+	conn, err := dialRetry(addr, maxRetries, backoff)
+	if err != nil {
+		return nil, err
+	}
+	return &retryConn{addr: addr, maxRetries: maxRetries, backoff: backoff, conn: conn}, nil
+}
+
+func dialRetry(addr string, maxRetries int, backoff time.Duration) (io.ReadWriteCloser, error) {
+	for i := 0; ; i++ {
+		conn, err := Dial(addr)
+		if err == nil {
+			return conn, nil
+		}
+		if i >= maxRetries {
+			return nil, err
+		}
+		time.Sleep(backoff << uint(i))
+	}
+}
+
+type retryConn struct {
+	addr       string
+	maxRetries int
+	backoff    time.Duration
+
+	mu   sync.Mutex // guards conn
+	conn io.ReadWriteCloser
+}
+
+func (c *retryConn) current() io.ReadWriteCloser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// reconnect replaces the failed connection, unless a concurrent
+// Read or Write did so already, and returns the new one.
+func (c *retryConn) reconnect(failed io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != failed {
+		return c.conn, nil
+	}
+	failed.Close()
+	conn, err := dialRetry(c.addr, c.maxRetries, c.backoff)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// retry runs op on the current connection, reconnecting
+// as long as it fails with a net.Error having done nothing.
+func (c *retryConn) retry(op func(io.ReadWriteCloser) (int, error)) (int, error) {
+	conn := c.current()
+	for i := 0; ; i++ {
+		n, err := op(conn)
+		var ne net.Error
+		if n > 0 || !errors.As(err, &ne) || i >= c.maxRetries {
+			return n, err
+		}
+		if conn, err = c.reconnect(conn); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *retryConn) Read(p []byte) (int, error) {
+	return c.retry(func(conn io.ReadWriteCloser) (int, error) {
+		return conn.Read(p)
+	})
+}
+
+func (c *retryConn) Write(p []byte) (int, error) {
+	return c.retry(func(conn io.ReadWriteCloser) (int, error) {
+		return conn.Write(p)
+	})
+}
+
+func (c *retryConn) Close() error {
+	return c.current().Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Serve starts a secure echo server on the given listener.
+// Each accepted connection is handled in its own goroutine,
+// errors of single connections are logged.
+// Serve returns when Accept fails with a non-temporary error.
+func Serve(l net.Listener) error {
+	return ServeWithOptions(l)
+}
+
+// ServeWithOptions is like Serve configured by opts.
+func ServeWithOptions(l net.Listener, opts ...Option) error {
+	s := &server{handler: logError}
+	for _, opt := range opts {
+		opt(&s.options)
+	}
+	return s.serve(context.Background(), l)
+}
+
+// ErrIdleTimeout is reported for connections closed by the server after
+// the client stayed silent for longer than set by IdleTimeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+func logError(err error) {
+	log.Printf("serve: %v", err)
+}
+
+// ServeWithHandler is like Serve but passes the errors of single
+// connections, e.g. a client failing the handshake, to handler
+// while continuing to accept. handler may be called concurrently.
+// A nil handler drops the errors.
+func ServeWithHandler(l net.Listener, handler func(error)) error {
+	return (&server{handler: handler}).serve(context.Background(), l)
+}
+
+// ServeContext is like Serve but returns ctx.Err() once ctx is done.
+// It then closes the listener and the open connections
+// and waits for their goroutines to finish.
+func ServeContext(ctx context.Context, l net.Listener) error {
+	return (&server{handler: logError}).serve(ctx, l)
+}
+
+// ServeWithKey is like Serve but presents pub, the public key of priv,
+// to every client instead of a fresh key per connection, giving the
+// server a stable identity clients can pin with DialAuthenticated.
+func ServeWithKey(l net.Listener, priv, pub *[KeySize]byte) error {
+	return (&server{handler: logError, priv: priv, pub: pub}).serve(context.Background(), l)
+}
+
+// server is the configuration of an echo server.
+type server struct {
+	handler   func(error)
+	priv, pub *[KeySize]byte // nil for a fresh key pair per connection
+	options
+}
+
+// serve accepts connections on l until Accept fails or ctx is done.
+func (s *server) serve(ctx context.Context, l net.Listener) error {
+	handler := s.handler
+	if handler == nil {
+		handler = func(error) {}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		conns  = make(map[net.Conn]struct{})
+		closed bool
+	)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks Accept and the connections' reads
+			l.Close()
+			mu.Lock()
+			closed = true
+			for c := range conns {
+				c.Close()
+			}
+			mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				wg.Wait()
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off like net/http does
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		mu.Lock()
+		if closed {
+			mu.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer func() {
+				mu.Lock()
+				delete(conns, c)
+				mu.Unlock()
+				wg.Done()
+			}()
+			defer func() {
+				if r := recover(); r != nil {
+					handler(fmt.Errorf("%s: panic: %v", c.RemoteAddr(), r))
+				}
+			}()
+			// errors of connections closed on shutdown are expected
+			if err := s.serveConn(c); err != nil && ctx.Err() == nil {
+				handler(fmt.Errorf("%s: %w", c.RemoteAddr(), err))
+			}
+		}(conn)
+	}
+}
+
+// Listen announces on addr, a TCP address like ":4000"
+// or a unix socket path prefixed by "unix:".
+func Listen(addr string) (net.Listener, error) {
+	return net.Listen(network(addr))
+}
+
+// ListenAndServe listens on addr as described for Listen
+// and then calls Serve to handle incoming connections.
+func ListenAndServe(addr string) error {
+	l, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("listening on %s", l.Addr())
+	return Serve(l)
+}
+
+// serveConn performs the handshake on conn and echoes
+// until the client closes the connection.
+func (s *server) serveConn(conn net.Conn) error {
+	defer conn.Close()
+	s.setup(conn)
+	s.startHandshake(conn)
+	var priv, peerPub *[KeySize]byte
+	var err error
+	if s.priv != nil {
+		priv, peerPub, err = handshakeKey(conn, s.pub, s.priv, ProtocolVersion)
+	} else {
+		priv, peerPub, err = Handshake(conn)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	sc, err := newSecureConn(conn, priv, peerPub, false)
+	if err != nil {
+		return err
+	}
+
+	// the reader hands over whole frames through WriteTo,
+	// the writer reseals them in frames of at most bufSize
+	sc.Writer.(*sW).chunk = s.bufSize
+
+	if s.idle > 0 {
+		sc.Reader.(*sR).r = &idleReader{conn, s.idle}
+	}
+
+	// echo until the client closes the connection
+	_, err = io.Copy(sc.Writer, sc.Reader)
+	var ne net.Error
+	if s.idle > 0 && errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("%w: silent for %v", ErrIdleTimeout, s.idle)
+	}
+	return err
+}
+
+// idleReader reads from conn, each read failing with a timeout
+// unless data arrives within d.
+type idleReader struct {
+	conn net.Conn
+	d    time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.d))
+	return r.conn.Read(p)
+}
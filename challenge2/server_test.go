@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeWithHandlerSurvivesBadClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errc := make(chan error, 1)
+	go ServeWithHandler(l, func(err error) { errc <- err })
+
+	bad, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Write([]byte{1, 2, 3, 4, 5})
+	bad.Close()
+	if err := <-errc; err == nil {
+		t.Fatal("Unexpected result: bad client reported no error")
+	}
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "secure.sock")
+	l, err := Listen("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go Serve(l)
+
+	conn, err := Dial("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "hello world\n"
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+	conn.Close()
+
+	// closing the listener removes the socket file
+	l.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected result: socket file %s was not removed: %v", sock, err)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- ServeContext(ctx, l) }()
+
+	// an open connection does not keep the server from returning
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected result: %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeContext did not return after the context was canceled")
+	}
+
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("Unexpected result: listener still accepts connections")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Unexpected result: connection still open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Unexpected result: connection was not closed")
+	}
+}
+
+func TestServeWithOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go ServeWithOptions(l, WithBufferSize(7))
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// echoed in many frames of 7 bytes
+	expected := strings.Repeat("hello world\n", 100)
+	if _, err := fmt.Fprint(conn, expected); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != expected {
+		t.Fatalf("Unexpected result:\nGot:\t\t%s\nExpected:\t%s\n", got, expected)
+	}
+}
+
+func BenchmarkServeConcurrent(b *testing.B) {
+	const clients = 8
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go ServeWithHandler(l, nil)
+
+	conns := make([]*SecureConn, clients)
+	for i := range conns {
+		if conns[i], err = Dial(l.Addr().String()); err != nil {
+			b.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+
+	msg := []byte(strings.Repeat("x", 1<<10))
+	latencies := make([][]time.Duration, clients)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		// each client echoes its share of the b.N messages
+		n := b.N / clients
+		if i < b.N%clients {
+			n++
+		}
+		wg.Add(1)
+		go func(i, n int, conn *SecureConn) {
+			defer wg.Done()
+			buf := make([]byte, len(msg))
+			for j := 0; j < n; j++ {
+				sent := time.Now()
+				if _, err := conn.Write(msg); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Error(err)
+					return
+				}
+				latencies[i] = append(latencies[i], time.Since(sent))
+			}
+		}(i, n, conn)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	p99 := all[len(all)*99/100]
+	b.ReportMetric(float64(p99.Microseconds()), "p99-us")
+	b.Logf("%d clients, %d messages of %d bytes: %.1f MB/s, p99 latency %v",
+		clients, len(all), len(msg), float64(len(all)*len(msg))/elapsed.Seconds()/1e6, p99)
+}
+
+func TestNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ServeWithOptions(l, NoDelay(noDelay))
+
+		conn, err := Dial(l.Addr().String(), NoDelay(noDelay))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// many small round trips
+		buf := make([]byte, 16)
+		for i := 0; i < 100; i++ {
+			expected := fmt.Sprintf("message %d\n", i)
+			if _, err := fmt.Fprint(conn, expected); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, buf[:len(expected)]); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:len(expected)]); got != expected {
+				t.Fatalf("Unexpected result: %s != %s", got, expected)
+			}
+		}
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	logs := new(syncBuffer)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const idle = 100 * time.Millisecond
+	go ServeWithOptions(l, IdleTimeout(idle))
+
+	conn, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// an active client outlives the timeout
+	buf := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			time.Sleep(idle / 2)
+		}
+		expected := fmt.Sprintf("message %d\n", i)
+		if _, err := fmt.Fprint(conn, expected); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf[:len(expected)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a silent one is dropped
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("Unexpected error: %v, expected %v", err, io.EOF)
+	}
+	if d := time.Since(start); d < idle/2 {
+		t.Fatalf("Unexpected result: closed after %v", d)
+	}
+	for deadline := time.Now().Add(time.Second); !strings.Contains(logs.String(), ErrIdleTimeout.Error()); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected result: no idle timeout in log:\n%s", logs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const timeout = 50 * time.Millisecond
+	go ServeWithOptions(l, HandshakeTimeout(timeout))
+
+	// a client never sending its key is dropped
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatalf("Unexpected error: %v, expected the server to close", err)
+	}
+	if d := time.Since(start); d < timeout/2 {
+		t.Fatalf("Unexpected result: closed after %v", d)
+	}
+}
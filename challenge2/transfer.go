@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SendFile streams the file at path to conn, usually a SecureConn,
+// ahead of its content a header of the big-endian 2 byte length of
+// its name, the name and its big-endian 8 byte size.
+func SendFile(conn io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	if len(name) > 0xffff {
+		return fmt.Errorf("file name of %d bytes too long", len(name))
+	}
+	hdr := make([]byte, 2+len(name)+8)
+	binary.BigEndian.PutUint16(hdr, uint16(len(name)))
+	copy(hdr[2:], name)
+	binary.BigEndian.PutUint64(hdr[2+len(name):], uint64(fi.Size()))
+	if _, err := conn.Write(hdr); err != nil {
+		return err
+	}
+	if n, err := io.Copy(conn, f); err != nil {
+		return err
+	} else if n != fi.Size() {
+		return fmt.Errorf("%s changed size: sent %d of %d bytes", path, n, fi.Size())
+	}
+	if fl, ok := conn.(interface {
+		Flush() error
+	}); ok {
+		return fl.Flush()
+	}
+	return nil
+}
+
+// RecvFile receives a file sent by SendFile from conn and writes it to
+// path, or into path under the name it was sent with if path is a
+// directory. A partially received file is removed.
+func RecvFile(conn io.Reader, path string) error {
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return err
+	}
+	name := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return err
+	}
+	var size int64
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("illegal file size %d", size)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		// the sender must not pick a place outside of path
+		base := filepath.Base(string(name))
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			return fmt.Errorf("illegal file name %q", name)
+		}
+		path = filepath.Join(path, base)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, conn, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
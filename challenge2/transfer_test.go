@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendRecvFile(t *testing.T) {
+	client, server, err := Loopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// many frames worth of random data
+	data := make([]byte, 1<<20+123)
+	if _, err := crand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "payload.bin")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- SendFile(client, src) }()
+
+	dir := t.TempDir()
+	if err := RecvFile(server, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "payload.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(data) {
+		t.Fatalf("Unexpected result: received %d bytes differing from the %d sent", len(got), len(data))
+	}
+}
+
+func TestRecvFileTruncated(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "payload.txt")
+	if err := ioutil.WriteFile(src, []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wire := new(bytes.Buffer)
+	if err := SendFile(wire, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "received.txt")
+	err := RecvFile(bytes.NewReader(wire.Bytes()[:wire.Len()-1]), dst)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Unexpected error: %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected result: partial file left behind: %v", err)
+	}
+}
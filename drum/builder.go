@@ -0,0 +1,45 @@
+package drum
+
+import "fmt"
+
+// PatternBuilder constructs a Pattern track by track,
+// e.g. NewPatternBuilder("0.808", 120).Track(0, "kick", "x---x---x---x---").Build().
+type PatternBuilder struct {
+	p   *Pattern
+	err error
+}
+
+// NewPatternBuilder returns a builder for a pattern
+// with the given version and tempo.
+func NewPatternBuilder(version string, tempo float32) *PatternBuilder {
+	return &PatternBuilder{p: &Pattern{version: version, tempo: tempo, tracks: make([]*Track, 0, 0)}}
+}
+
+// Track adds a track whose steps are given as a string
+// of 'x' for a hit and '-' for a rest.
+func (b *PatternBuilder) Track(id int32, name string, steps string) *PatternBuilder {
+	if b.err != nil {
+		return b
+	}
+	s := make([]byte, len(steps))
+	for i, c := range []byte(steps) {
+		switch c {
+		case 'x':
+			s[i] = 1
+		case '-':
+		default:
+			b.err = fmt.Errorf("track %d: invalid step %q at %d", id, c, i)
+			return b
+		}
+	}
+	b.err = b.p.AddTrack(id, name, s)
+	return b
+}
+
+// Build returns the pattern, or the first error of adding its tracks.
+func (b *PatternBuilder) Build() (*Pattern, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.p.Clone(), nil
+}
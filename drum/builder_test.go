@@ -0,0 +1,38 @@
+package drum
+
+import "testing"
+
+func TestPatternBuilder(t *testing.T) {
+	p, err := NewPatternBuilder("0.808-alpha", 120).
+		Track(0, "kick", "x---x---x---x---").
+		Track(1, "snare", "----x-------x---").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Saved with HW Version: 0.808-alpha
+Tempo: 120
+(0) kick	|x---|x---|x---|x---|
+(1) snare	|----|x---|----|x---|
+`
+	if p.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", p, expected)
+	}
+
+	tData := []struct {
+		steps string
+		err   string
+	}{
+		{"x---x---x---x--", "track 2: want 16 steps, got 15"},
+		{"x---x---x---x--o", "track 2: invalid step 'o' at 15"},
+	}
+	for _, exp := range tData {
+		_, err := NewPatternBuilder("0.808-alpha", 120).
+			Track(1, "kick", "x---x---x---x---").
+			Track(2, "snare", exp.steps).
+			Build()
+		if err == nil || err.Error() != exp.err {
+			t.Fatalf("Unexpected error %v, expected %q", err, exp.err)
+		}
+	}
+}
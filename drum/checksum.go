@@ -0,0 +1,44 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// ErrChecksumMismatch is returned by DecodeChecksummed
+// for data that was altered after encoding.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// EncodeChecksummed writes the pattern to w like Encode,
+// followed by the big-endian CRC-32 (IEEE) of the encoded pattern.
+func EncodeChecksummed(w io.Writer, p *Pattern) error {
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, p); err != nil {
+		return err
+	}
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// DecodeChecksummed decodes a pattern written by EncodeChecksummed,
+// failing with ErrChecksumMismatch if the checksum does not match.
+func DecodeChecksummed(r io.Reader) (*Pattern, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < 4 {
+		return nil, fmt.Errorf("file too short: need at least 4 bytes for checksum, got %d", len(content))
+	}
+	content, sum := content[:len(content)-4], binary.BigEndian.Uint32(content[len(content)-4:])
+	if got := crc32.ChecksumIEEE(content); got != sum {
+		return nil, fmt.Errorf("%w: got %08x, want %08x", ErrChecksumMismatch, got, sum)
+	}
+	return DecodeOptions{}.decode(bytes.NewBuffer(content))
+}
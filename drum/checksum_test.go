@@ -0,0 +1,29 @@
+package drum
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChecksummed(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+	buf := new(bytes.Buffer)
+	if err := EncodeChecksummed(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+
+	decoded, err := DecodeChecksummed(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(p) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, p)
+	}
+
+	content[0x3c] ^= 1 // second step of the kick
+	if _, err := DecodeChecksummed(bytes.NewReader(content)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Unexpected error %v, expected %v", err, ErrChecksumMismatch)
+	}
+}
@@ -0,0 +1,47 @@
+// Command drum prints the pattern of a .splice drum machine file.
+//
+// Usage:
+//
+//	drum [-json] <file>
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/kenix/golang-challenge/drum"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run decodes the file named in args and prints it to w.
+func run(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("drum", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the pattern as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: drum [-json] <file>")
+	}
+	p, err := drum.DecodeFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+	_, err = fmt.Fprint(w, p)
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"testing"
+)
+
+var fixture = path.Join("..", "..", "fixtures", "pattern_2.splice")
+
+func TestRun(t *testing.T) {
+	out := new(bytes.Buffer)
+	if err := run([]string{fixture}, out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Saved with HW Version: 0.808-alpha
+Tempo: 98.4
+(0) kick	|x---|----|x---|----|
+(1) snare	|----|x---|----|x---|
+(3) hh-open	|--x-|--x-|x-x-|--x-|
+(5) cowbell	|----|----|x---|----|
+`
+	if out.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", out, expected)
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	out := new(bytes.Buffer)
+	if err := run([]string{"-json", fixture}, out); err != nil {
+		t.Fatal(err)
+	}
+	var p struct {
+		Version string
+		Tempo   float32
+		Tracks  []struct{ Name string }
+	}
+	if err := json.Unmarshal(out.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != "0.808-alpha" || p.Tempo != 98.4 || len(p.Tracks) != 4 || p.Tracks[3].Name != "cowbell" {
+		t.Fatalf("Unexpected result: %s", out)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	if err := run(nil, new(bytes.Buffer)); err == nil {
+		t.Fatal("Unexpected result: no error without a file")
+	}
+}
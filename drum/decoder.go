@@ -1,9 +1,12 @@
 package drum
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -11,56 +14,328 @@ import (
 
 // DecodeFile decodes the drum machine file found at the provided path
 // and returns a pointer to a parsed pattern which is the entry point to the
-// rest of the data.
+// rest of the data. A gzip compressed file, told by its magic bytes,
+// is decompressed on the fly.
 func DecodeFile(path string) (*Pattern, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	content, err := readAll(f)
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return Decode(zr)
+	}
+	return Decode(br)
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Decode decodes the drum machine data read from r
+// and returns a pointer to the parsed pattern.
+func Decode(r io.Reader) (*Pattern, error) {
+	return DecodeOptions{}.Decode(r)
+}
+
+// DecodeBytes decodes the drum machine data in b. The pattern does
+// not share memory with b.
+func DecodeBytes(b []byte) (*Pattern, error) {
+	return Decode(bytes.NewReader(b))
+}
+
+// DecodeOptions adapt decoding to files deviating from the format.
+// The zero value decodes like Decode.
+type DecodeOptions struct {
+	// TempoByteOrder is the byte order of the tempo,
+	// binary.LittleEndian if nil.
+	TempoByteOrder binary.ByteOrder
+	// AllowVelocity keeps step values beyond 1 as the velocity of
+	// the hit, see Track.Velocities, instead of failing on them.
+	AllowVelocity bool
+	// AllowPartialTrack keeps a last track too short for its name
+	// or steps as the trailing bytes of the pattern, see
+	// Pattern.Trailing, instead of failing on it.
+	AllowPartialTrack bool
+	// If MaxTempo is positive, the tempo is clamped into
+	// [MinTempo, MaxTempo], see Pattern.ClampTempo.
+	MinTempo, MaxTempo float32
+}
+
+// Decode decodes the drum machine data read from r like the
+// package level Decode, adapted by o.
+func (o DecodeOptions) Decode(r io.Reader) (*Pattern, error) {
+	content, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return o.decode(bytes.NewBuffer(content))
+}
+
+// Meta describes the layout of decoded drum machine data.
+type Meta struct {
+	DeclaredLength int64 // length of the content following the header
+	ExtraBytes     int   // bytes following the content
+}
+
+// DecodeWithMeta is like Decode but also returns the layout of the data.
+func DecodeWithMeta(r io.Reader) (*Pattern, Meta, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, Meta{}, err
+	}
 	buf := bytes.NewBuffer(content)
+	p, err := DecodeOptions{}.decode(buf)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	length := int64(binary.BigEndian.Uint64(content[6:14]))
+	return p, Meta{length, buf.Len()}, nil
+}
+
+// DecodeStream decodes the concatenated drum machine data read from r
+// pattern by pattern, calling fn with each track as soon as the pattern
+// holding it was read. p has the version and tempo of that pattern but
+// no tracks, they are not collected. Unlike DecodeAll, DecodeStream
+// holds only a single pattern in memory, not all of r.
+// It stops at the first error, including one returned by fn, wrapping
+// it with the number of the pattern, test for it with errors.Is.
+func DecodeStream(r io.Reader, fn func(p *Pattern, t *Track) error) error {
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		}
+		if err := decodeNext(br, fn); err != nil {
+			return fmt.Errorf("pattern %d: %w", n, err)
+		}
+	}
+}
+
+// decodeNext reads the next SPLICE block from r, passing its tracks to fn.
+func decodeNext(r io.Reader, fn func(*Pattern, *Track) error) error {
+	var hdr [14]byte
+	if n, err := io.ReadFull(r, hdr[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("truncated header: need 14 bytes, got %d", n)
+	} else if err != nil {
+		return err
+	}
+	if prtcl := string(hdr[:6]); "SPLICE" != prtcl {
+		return fmt.Errorf("want SPLICE, got %s", prtcl)
+	}
+	length := int64(binary.BigEndian.Uint64(hdr[6:]))
+	if length < 0 {
+		return fmt.Errorf("invalid declared length %d", length)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) < length {
+		return fmt.Errorf("declared length %d exceeds available %d", length, len(content))
+	}
+	p := new(Pattern)
+	return DecodeOptions{}.decodeContent(p, content, func(t *Track) error { return fn(p, t) })
+}
+
+// DecodeAll decodes the concatenated drum machine data read from r,
+// using the length of each SPLICE block to find the next one.
+// Data following a block that is not a SPLICE block is an error,
+// wrapped with the number of the pattern like by DecodeStream.
+func DecodeAll(r io.Reader) ([]*Pattern, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var ps []*Pattern
+	for buf := bytes.NewBuffer(content); buf.Len() > 0; {
+		p, err := DecodeOptions{}.decode(buf)
+		if err != nil {
+			return ps, fmt.Errorf("pattern %d: %w", len(ps)+1, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// Validate checks the structure of the drum machine data read from r,
+// its header, length, track names and steps, without collecting
+// a pattern. It returns the first error Decode would fail with.
+func Validate(r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	content, err = splitBlock(bytes.NewBuffer(content))
+	if err != nil {
+		return err
+	}
+	return DecodeOptions{}.decodeContent(new(Pattern), content, func(*Track) error { return nil })
+}
+
+// splitBlock consumes the SPLICE block at the start of buf
+// and returns its content, the part following the length.
+func splitBlock(buf *bytes.Buffer) ([]byte, error) {
+	if buf.Len() < 6 {
+		return nil, fmt.Errorf("file too short: need at least 6 bytes for magic, got %d", buf.Len())
+	}
 	prtcl := string(buf.Next(6))
 	if "SPLICE" != prtcl {
 		return nil, fmt.Errorf("want SPLICE, got %s", prtcl)
 	}
+	if buf.Len() < 8 {
+		return nil, fmt.Errorf("truncated header: need 8 bytes for length, got %d", buf.Len())
+	}
 	var length int64
-	if err = binary.Read(buf, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
 		return nil, err
 	}
-	buf = bytes.NewBuffer(buf.Next(int(length)))
+	if length < 0 || length > int64(buf.Len()) {
+		return nil, fmt.Errorf("declared length %d exceeds available %d", length, buf.Len())
+	}
+	return buf.Next(int(length)), nil
+}
+
+// decode parses the SPLICE block at the start of buf,
+// consuming it from buf.
+func (o DecodeOptions) decode(buf *bytes.Buffer) (*Pattern, error) {
+	content, err := splitBlock(buf)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pattern{tracks: make([]*Track, 0, 0)}
+	err = o.decodeContent(p, content, func(t *Track) error {
+		p.addTrack(t)
+		return nil
+	})
+	return p, err
+}
+
+// decodeContent parses the content of a SPLICE block, the part
+// following its length, setting the version and tempo of p
+// and passing each track to fn. Fewer than 5 bytes after the last
+// track, too few for the id and name length of another one, are kept
+// as the trailing bytes of p, a partial track is an error unless
+// o.AllowPartialTrack.
+func (o DecodeOptions) decodeContent(p *Pattern, content []byte, fn func(*Track) error) error {
+	if len(content) < 36 {
+		return fmt.Errorf("truncated header: need 36 bytes for version and tempo, got %d", len(content))
+	}
+	buf := bytes.NewBuffer(content)
 	version := strings.TrimRight(string(buf.Next(32)), "\x00")
+	order := o.TempoByteOrder
+	if order == nil {
+		order = binary.LittleEndian
+	}
 	var tempo float32
-	if err = binary.Read(buf, binary.LittleEndian, &tempo); err != nil {
-		return nil, err
+	if err := binary.Read(buf, order, &tempo); err != nil {
+		return err
+	}
+	p.version, p.tempo = version, tempo
+	if o.MaxTempo > 0 {
+		p.ClampTempo(o.MinTempo, o.MaxTempo)
 	}
 
-	p := &Pattern{version, tempo, make([]*Track, 0, 0)}
+	n := stepCount(buf.Bytes(), o.AllowPartialTrack)
 	for buf.Len() > 0 {
+		if buf.Len() < 5 {
+			// not even the id and name length of a track
+			p.trailing = append([]byte(nil), buf.Next(buf.Len())...)
+			break
+		}
+		rest := buf.Bytes()
 		var id int32
-		if err = binary.Read(buf, binary.LittleEndian, &id); err != nil {
-			return p, err
+		if err := binary.Read(buf, binary.LittleEndian, &id); err != nil {
+			return err
 		}
 		c, err := buf.ReadByte()
 		if err != nil {
-			return p, err
+			return err
+		}
+		if int(c)+n > buf.Len() && o.AllowPartialTrack {
+			p.trailing = append([]byte(nil), rest...)
+			break
+		}
+		if int(c) > buf.Len() {
+			return fmt.Errorf("track %d: name length %d exceeds remaining %d bytes", id, c, buf.Len())
+		}
+		if int(c)+n > buf.Len() {
+			return fmt.Errorf("track %d: %d steps exceed remaining %d bytes", id, n, buf.Len()-int(c))
 		}
 		name := string(buf.Next(int(c)))
-		p.addTrack(&Track{id, name, buf.Next(16)})
+		steps := buf.Next(n)
+		for i, s := range steps {
+			if s > 1 && !o.AllowVelocity {
+				return fmt.Errorf("track %d: invalid step value %#x at %d", id, s, i)
+			}
+		}
+		if err := fn(&Track{id, name, steps}); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return p, nil
+// stepCounts are the numbers of steps per track patterns are made of.
+var stepCounts = []int{16, 32, 64}
+
+// stepCount infers the number of steps per track from the track records
+// in content: the first of stepCounts for which the records take up
+// content exactly. Failing that, trailing bytes may follow: the first
+// for which at least one record fits, all records hold nothing but 0s
+// and 1s as steps and fewer than 5 bytes, too few for the id and name
+// length of another record, remain. If partial, a partial record may
+// take their place as a last resort. It falls back to 16 if none does.
+func stepCount(content []byte, partial bool) int {
+	const (
+		exact = iota
+		short
+		lenient
+	)
+	last := short
+	if partial {
+		last = lenient
+	}
+	for mode := exact; mode <= last; mode++ {
+	next:
+		for _, n := range stepCounts {
+			rest, records := content, 0
+			for len(rest) >= 5 {
+				// id, name length, name, steps
+				l := 5 + int(rest[4]) + n
+				if l > len(rest) {
+					if mode == lenient && records > 0 {
+						break
+					}
+					continue next
+				}
+				if mode != exact && !plainSteps(rest[l-n:l]) {
+					continue next
+				}
+				rest = rest[l:]
+				records++
+			}
+			if mode == exact && len(rest) == 0 || mode != exact && records > 0 {
+				return n
+			}
+		}
+	}
+	return stepCounts[0]
 }
 
-func readAll(f *os.File) ([]byte, error) {
-	defer f.Close()
-	cntnt, err := ioutil.ReadAll(f)
-	if err != nil {
-		return nil, err
+// plainSteps reports whether steps holds nothing but 0s and 1s.
+func plainSteps(steps []byte) bool {
+	for _, s := range steps {
+		if s > 1 {
+			return false
+		}
 	}
-	return cntnt, nil
+	return true
 }
 
 // Pattern is the high level representation of the
@@ -68,29 +343,108 @@ func readAll(f *os.File) ([]byte, error) {
 type Pattern struct {
 	version string // 32
 	tempo   float32
+	swing   float32 // percent of a step every second step is delayed
 	tracks  []*Track
+	muted   map[int32]bool // by track id
+	soloed  map[int32]bool // by track id
+	// bytes after the last track, written back by Encode
+	trailing []byte
+
+	// tempo before ClampTempo changed it, if clamped
+	rawTempo float32
+	clamped  bool
 }
 
 func (p *Pattern) addTrack(t *Track) {
 	p.tracks = append(p.tracks, t)
 }
 
+// stepCount returns the largest number of steps of the pattern's tracks,
+// 16 for a pattern without tracks.
+func (p *Pattern) stepCount() int {
+	n := stepCounts[0]
+	for _, t := range p.tracks {
+		if len(t.steps) > n {
+			n = len(t.steps)
+		}
+	}
+	return n
+}
+
+// Version returns the hardware version the pattern was saved with.
+func (p *Pattern) Version() string {
+	return p.version
+}
+
+// Tempo returns the tempo in beats per minute.
+func (p *Pattern) Tempo() float32 {
+	return p.tempo
+}
+
+// Tracks returns the tracks of the pattern in file order.
+func (p *Pattern) Tracks() []*Track {
+	return append([]*Track(nil), p.tracks...)
+}
+
 func (p *Pattern) String() string {
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "Saved with HW Version: %s\n", p.version)
 	fmt.Fprintf(buf, "Tempo: %g\n", p.tempo)
 	for _, t := range p.tracks {
-		fmt.Fprintf(buf, "%s\n", t)
+		if p.audible(t) {
+			fmt.Fprintf(buf, "%s\n", t)
+		}
 	}
 	return buf.String()
 }
 
+// Track is a single instrument of a Pattern
+// with its steps, 1 meaning a hit and 0 a rest. Decoded with
+// DecodeOptions.AllowVelocity, any non-zero step is a hit.
 type Track struct {
 	id    int32
 	name  string
 	steps []byte
 }
 
+// ID returns the id of the track.
+func (t *Track) ID() int32 {
+	return t.id
+}
+
+// Name returns the name of the track's instrument.
+func (t *Track) Name() string {
+	return t.name
+}
+
+// StepCount returns the number of steps of the track.
+func (t *Track) StepCount() int {
+	return len(t.steps)
+}
+
+// Steps returns a copy of the track's steps.
+func (t *Track) Steps() []byte {
+	return append([]byte(nil), t.steps...)
+}
+
+// Velocities returns a copy of the track's steps as velocities
+// from 0 to 255, 0 meaning a rest. Unless decoded with
+// DecodeOptions.AllowVelocity, every hit has a velocity of 1.
+func (t *Track) Velocities() []byte {
+	return append([]byte(nil), t.steps...)
+}
+
+// HitCount returns the number of steps of the track that are hits.
+func (t *Track) HitCount() int {
+	var n int
+	for _, s := range t.steps {
+		if s != 0 {
+			n++
+		}
+	}
+	return n
+}
+
 func (t *Track) String() string {
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "(%d) %s\t", t.id, t.name)
@@ -98,13 +452,10 @@ func (t *Track) String() string {
 		if i%4 == 0 {
 			fmt.Fprintf(buf, "|")
 		}
-		switch s {
-		case 0:
+		if s == 0 {
 			fmt.Fprintf(buf, "-")
-		case 1:
+		} else {
 			fmt.Fprintf(buf, "x")
-		default:
-			panic(fmt.Errorf("invalid step value % x", s))
 		}
 	}
 	fmt.Fprintf(buf, "|")
@@ -1,9 +1,17 @@
 package drum
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"path"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestDecodeFile(t *testing.T) {
@@ -73,3 +81,537 @@ Tempo: 999
 		}
 	}
 }
+
+func TestAccessors(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_2.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := decoded.Version(); v != "0.808-alpha" {
+		t.Fatalf("Unexpected version %q", v)
+	}
+	if tempo := decoded.Tempo(); tempo != 98.4 {
+		t.Fatalf("Unexpected tempo %g", tempo)
+	}
+	tData := []struct {
+		id    int32
+		name  string
+		steps []byte
+	}{
+		{0, "kick", []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{1, "snare", []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}},
+		{3, "hh-open", []byte{0, 0, 1, 0, 0, 0, 1, 0, 1, 0, 1, 0, 0, 0, 1, 0}},
+		{5, "cowbell", []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	tracks := decoded.Tracks()
+	if len(tracks) != len(tData) {
+		t.Fatalf("Unexpected number of tracks %d", len(tracks))
+	}
+	for i, exp := range tData {
+		tr := tracks[i]
+		if tr.ID() != exp.id || tr.Name() != exp.name || !bytes.Equal(tr.Steps(), exp.steps) {
+			t.Fatalf("Unexpected track (%d) %s %v, expected (%d) %s %v",
+				tr.ID(), tr.Name(), tr.Steps(), exp.id, exp.name, exp.steps)
+		}
+	}
+
+	// Steps is a copy
+	tracks[0].Steps()[1] = 1
+	if tracks[0].Steps()[1] != 0 {
+		t.Fatal("Steps exposed the track's steps")
+	}
+}
+
+func TestHitCount(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{4, 2, 2, 5, 4, 1}
+	for i, tr := range decoded.Tracks() {
+		if n := tr.HitCount(); n != expected[i] {
+			t.Fatalf("Unexpected hit count %d of %s, expected %d", n, tr.Name(), expected[i])
+		}
+	}
+	if n := decoded.TotalHits(); n != 18 {
+		t.Fatalf("Unexpected total hits %d, expected 18", n)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(expected) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, expected)
+	}
+}
+
+func TestDecodeFileGzip(t *testing.T) {
+	fp := path.Join("fixtures", "pattern_3.splice")
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	zw.Write(content)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz := path.Join(t.TempDir(), "pattern_3.splice.gz")
+	if err := ioutil.WriteFile(gz, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeFile(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := DecodeFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(expected) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, expected)
+	}
+
+	// a corrupt gzip stream fails to decode
+	corrupt := buf.Bytes()[:buf.Len()/2]
+	if err := ioutil.WriteFile(gz, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeFile(gz); err == nil {
+		t.Fatal("Unexpected result: decoded a truncated gzip file")
+	}
+}
+
+func TestDecodeBytes(t *testing.T) {
+	fp := path.Join("fixtures", "pattern_2.splice")
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBytes(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := DecodeFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(expected) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, expected)
+	}
+	// the pattern is independent of content
+	for i := range content {
+		content[i] = 0
+	}
+	if !decoded.Equal(expected) {
+		t.Fatalf("Unexpected result: pattern changed with its input:\n%s", decoded)
+	}
+}
+
+func TestDecodeWithMeta(t *testing.T) {
+	tData := []struct {
+		path string
+		meta Meta
+	}{
+		{"pattern_1.splice", Meta{197, 0}},
+		{"pattern_5.splice", Meta{87, 31}},
+	}
+	for _, exp := range tData {
+		content, err := ioutil.ReadFile(path.Join("fixtures", exp.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, meta, err := DecodeWithMeta(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != exp.meta {
+			t.Fatalf("%s: unexpected meta %+v, expected %+v", exp.path, meta, exp.meta)
+		}
+		if !p.Equal(decodeFixture(t, exp.path)) {
+			t.Fatalf("%s: unexpected pattern\n%s", exp.path, p)
+		}
+	}
+}
+
+func TestDecodeOptionsTempoByteOrder(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// store the tempo big-endian
+	tempo := content[0x2e:0x32]
+	tempo[0], tempo[1], tempo[2], tempo[3] = tempo[3], tempo[2], tempo[1], tempo[0]
+
+	decoded, err := DecodeOptions{TempoByteOrder: binary.BigEndian}.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeFixture(t, "pattern_1.splice")
+	if !decoded.Equal(expected) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, expected)
+	}
+
+	decoded, err = Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Tempo() == expected.Tempo() {
+		t.Fatal("big-endian tempo decoded as little-endian")
+	}
+}
+
+func TestDecodeInvalidStep(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0x3c] = 2 // second step of the kick
+	_, err = Decode(bytes.NewReader(content))
+	if err == nil {
+		t.Fatal("corrupt step decoded without error")
+	}
+	if exp := "track 0: invalid step value 0x2 at 1"; err.Error() != exp {
+		t.Fatalf("Unexpected error %q, expected %q", err, exp)
+	}
+}
+
+func TestDecodeOptionsAllowVelocity(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0x3b] = 127 // first step of the kick, an accent
+	content[0x3c] = 64  // second step of the kick, a soft hit
+	if _, err := Decode(bytes.NewReader(content)); err == nil {
+		t.Fatal("velocity decoded without error by default")
+	}
+	decoded, err := DecodeOptions{AllowVelocity: true}.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kick := decoded.Tracks()[0]
+	expected := []byte{127, 64, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}
+	if v := kick.Velocities(); !bytes.Equal(v, expected) {
+		t.Fatalf("Unexpected velocities %v, expected %v", v, expected)
+	}
+	if s, exp := kick.String(), "(0) kick\t|xx--|x---|x---|x---|"; s != exp {
+		t.Fatalf("Unexpected result %q, expected %q", s, exp)
+	}
+	if n := kick.HitCount(); n != 5 {
+		t.Fatalf("Unexpected hit count %d, expected 5", n)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = content[:94] // 80 bytes after the header
+	_, err = Decode(bytes.NewReader(content))
+	if err == nil {
+		t.Fatal("truncated file decoded without error")
+	}
+	if exp := "declared length 197 exceeds available 80"; err.Error() != exp {
+		t.Fatalf("Unexpected error %q, expected %q", err, exp)
+	}
+}
+
+func TestDecodeTruncatedTrack(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kick and a snare with 12 of its 16 steps
+	const kickEnd = 14 + 32 + 4 + 5 + 4 + 16
+	truncated := append([]byte(nil), content[:kickEnd+5+5+12]...)
+	binary.BigEndian.PutUint64(truncated[6:14], uint64(len(truncated)-14))
+
+	exp := "track 1: 16 steps exceed remaining 12 bytes"
+	if _, err := Decode(bytes.NewReader(truncated)); err == nil || err.Error() != exp {
+		t.Fatalf("Unexpected error %v, expected %q", err, exp)
+	}
+	if err := Validate(bytes.NewReader(truncated)); err == nil || err.Error() != exp {
+		t.Fatalf("Unexpected Validate error %v, expected %q", err, exp)
+	}
+
+	// the kick alone still decodes
+	kick := append([]byte(nil), content[:kickEnd]...)
+	binary.BigEndian.PutUint64(kick[6:14], uint64(len(kick)-14))
+	p, err := Decode(bytes.NewReader(kick))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tracks()) != 1 || len(p.Trailing()) != 0 {
+		t.Fatalf("Unexpected result:\n%s", p)
+	}
+
+	// unless the partial snare is kept as trailing bytes
+	p, err = DecodeOptions{AllowPartialTrack: true}.Decode(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Tracks()) != 1 || !bytes.Equal(p.Trailing(), truncated[kickEnd:]) {
+		t.Fatalf("Unexpected result:\n%s\ntrailing % x", p, p.Trailing())
+	}
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), truncated) {
+		t.Fatalf("Unexpected encoding:\n% x\nexpected:\n% x", buf.Bytes(), truncated)
+	}
+}
+
+func TestDecodeNameTooLong(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlong := append([]byte(nil), content...)
+	overlong[0x36] = 0xff // name length of the kick
+
+	// a track of 8 steps after a 10 byte name
+	short := append(append([]byte(nil), content...), 9, 0, 0, 0, 10)
+	short = append(short, "long-snare"...)
+	short = append(short, 1, 0, 0, 0, 1, 0, 0, 0)
+	binary.BigEndian.PutUint64(short[6:14], uint64(len(short)-14))
+
+	tData := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"overlong name", overlong, "track 0: name length 255 exceeds remaining 156 bytes"},
+		{"short steps", short, "track 9: 16 steps exceed remaining 8 bytes"},
+	}
+	for _, exp := range tData {
+		_, err := Decode(bytes.NewReader(exp.content))
+		if err == nil || err.Error() != exp.err {
+			t.Fatalf("%s: unexpected error %v, expected %q", exp.name, err, exp.err)
+		}
+		if err := Validate(bytes.NewReader(exp.content)); err == nil || err.Error() != exp.err {
+			t.Fatalf("%s: unexpected Validate error %v, expected %q", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestDecodeShort(t *testing.T) {
+	tData := []struct {
+		content string
+		err     string
+	}{
+		{"", "file too short: need at least 6 bytes for magic, got 0"},
+		{"SPL", "file too short: need at least 6 bytes for magic, got 3"},
+		{"SPLICE\x00\x00\x00\x00", "truncated header: need 8 bytes for length, got 4"},
+		{"SPLICE\x00\x00\x00\x00\x00\x00\x00\x0a0.808-alph", "truncated header: need 36 bytes for version and tempo, got 10"},
+		{"SPLICE\x00\x00\x00\x00\x00\x00\x00\x22" + strings.Repeat("\x00", 34), "truncated header: need 36 bytes for version and tempo, got 34"},
+	}
+	for _, exp := range tData {
+		_, err := Decode(strings.NewReader(exp.content))
+		if err == nil || err.Error() != exp.err {
+			t.Fatalf("%d bytes: unexpected error %v, expected %q", len(exp.content), err, exp.err)
+		}
+	}
+}
+
+// repeatReader yields n copies of block without holding them in memory.
+type repeatReader struct {
+	block []byte
+	n     int
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	c := copy(p, r.block[r.off:])
+	if r.off += c; r.off == len(r.block) {
+		r.off = 0
+		r.n--
+	}
+	return c, nil
+}
+
+func TestDecodeStream(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := decodeFixture(t, "pattern_1.splice")
+
+	const patterns = 10000 // 2M
+	var tracks int
+	err = DecodeStream(&repeatReader{block: content, n: patterns}, func(p *Pattern, tr *Track) error {
+		if p.Version() != expected.Version() || p.Tempo() != expected.Tempo() {
+			return fmt.Errorf("unexpected header %q %g", p.Version(), p.Tempo())
+		}
+		if exp := expected.tracks[tracks%len(expected.tracks)]; !tr.Equal(exp) {
+			return fmt.Errorf("unexpected track %s, expected %s", tr, exp)
+		}
+		tracks++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := patterns * len(expected.tracks); tracks != exp {
+		t.Fatalf("Unexpected number of tracks %d, expected %d", tracks, exp)
+	}
+
+	// a byte at a time, ending in a truncated pattern
+	content = append(content, content[:100]...)
+	tracks = 0
+	err = DecodeStream(iotest.OneByteReader(bytes.NewReader(content)), func(p *Pattern, tr *Track) error {
+		tracks++
+		return nil
+	})
+	if exp := "pattern 2: declared length 197 exceeds available 86"; err == nil || err.Error() != exp {
+		t.Fatalf("Unexpected error %v, expected %q", err, exp)
+	}
+	if tracks != len(expected.tracks) {
+		t.Fatalf("Unexpected number of tracks %d, expected %d", tracks, len(expected.tracks))
+	}
+
+	// errors of fn and of the reader are kept
+	stop := errors.New("stop")
+	err = DecodeStream(bytes.NewReader(content), func(p *Pattern, tr *Track) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("Unexpected error %v, expected %v", err, stop)
+	}
+	readErr := errors.New("read failed")
+	err = DecodeStream(io.MultiReader(strings.NewReader("SPL"), iotest.ErrReader(readErr)), func(p *Pattern, tr *Track) error {
+		return nil
+	})
+	if !errors.Is(err, readErr) {
+		t.Fatalf("Unexpected error %v, expected %v", err, readErr)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate(bytes.NewReader(content)); err != nil {
+		t.Fatalf("valid file: %v", err)
+	}
+
+	corrupt := func(i int, b byte) []byte {
+		c := append([]byte(nil), content...)
+		c[i] = b
+		return c
+	}
+	tData := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"magic", corrupt(0, 'X'), "want SPLICE, got XPLICE"},
+		{"truncated", content[:100], "declared length 197 exceeds available 86"},
+		{"name length", corrupt(0x36, 0xff), "track 0: name length 255 exceeds remaining 156 bytes"},
+		{"step", corrupt(0x3c, 2), "track 0: invalid step value 0x2 at 1"},
+	}
+	for _, exp := range tData {
+		if err := Validate(bytes.NewReader(exp.content)); err == nil || err.Error() != exp.err {
+			t.Fatalf("%s: unexpected error %v, expected %q", exp.name, err, exp.err)
+		}
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	var content []byte
+	var expected []*Pattern
+	for _, name := range []string{"pattern_1.splice", "pattern_2.splice"} {
+		b, err := ioutil.ReadFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, b...)
+		p, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, p)
+	}
+
+	decoded, err := DecodeAll(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(expected) {
+		t.Fatalf("Unexpected number of patterns %d, expected %d", len(decoded), len(expected))
+	}
+	for i := range expected {
+		if fmt.Sprint(decoded[i]) != fmt.Sprint(expected[i]) {
+			t.Fatalf("Pattern %d\nGot:\n%s\nExpected:\n%s", i+1, decoded[i], expected[i])
+		}
+	}
+
+	// trailing garbage
+	content = append(content, "garbage"...)
+	_, err = DecodeAll(bytes.NewReader(content))
+	if err == nil {
+		t.Fatal("trailing garbage decoded without error")
+	}
+	if exp := "pattern 3: want SPLICE, got garbag"; err.Error() != exp || errors.Unwrap(err) == nil {
+		t.Fatalf("Unexpected error %v, expected %q wrapping the error of the pattern", err, exp)
+	}
+}
+
+func TestDecode32Steps(t *testing.T) {
+	p := &Pattern{version: "0.808-alpha", tempo: 120}
+	steps := make([]byte, 32)
+	for i := range steps {
+		if i%3 == 0 {
+			steps[i] = 1
+		}
+	}
+	for id, name := range []string{"kick", "snare"} {
+		if err := p.AddTrack(int32(id), name, steps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.AddTrack(2, "short", steps[:16]); err == nil {
+		t.Fatal("16 steps added to a 32 step pattern")
+	}
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, p); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range decoded.Tracks() {
+		if tr.StepCount() != 32 || !bytes.Equal(tr.Steps(), steps) {
+			t.Fatalf("Unexpected steps %v", tr.Steps())
+		}
+	}
+	expected := `Saved with HW Version: 0.808-alpha
+Tempo: 120
+(0) kick	|x--x|--x-|-x--|x--x|--x-|-x--|x--x|--x-|
+(1) snare	|x--x|--x-|-x--|x--x|--x-|-x--|x--x|--x-|
+`
+	if fmt.Sprint(decoded) != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", decoded, expected)
+	}
+}
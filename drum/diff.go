@@ -0,0 +1,59 @@
+package drum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diff reports the differences between pattern a and pattern b,
+// one line each: version, tempo and swing changes, tracks removed from a
+// and added in b by id, and for tracks in both the changed name
+// and the indices of the steps that differ.
+// Identical patterns have no differences.
+func Diff(a, b *Pattern) []string {
+	var diff []string
+	if a.version != b.version {
+		diff = append(diff, fmt.Sprintf("version: %q -> %q", a.version, b.version))
+	}
+	if a.tempo != b.tempo {
+		diff = append(diff, fmt.Sprintf("tempo: %g -> %g", a.tempo, b.tempo))
+	}
+	if a.swing != b.swing {
+		diff = append(diff, fmt.Sprintf("swing: %g%% -> %g%%", a.swing, b.swing))
+	}
+
+	byID := make(map[int32]*Track, len(b.tracks))
+	for _, t := range b.tracks {
+		byID[t.id] = t
+	}
+	for _, ta := range a.tracks {
+		tb, ok := byID[ta.id]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("track %d: removed %s", ta.id, ta))
+			continue
+		}
+		delete(byID, ta.id)
+		if ta.name != tb.name {
+			diff = append(diff, fmt.Sprintf("track %d: name %q -> %q", ta.id, ta.name, tb.name))
+		}
+		if len(ta.steps) != len(tb.steps) {
+			diff = append(diff, fmt.Sprintf("track %d: %d steps -> %d steps", ta.id, len(ta.steps), len(tb.steps)))
+			continue
+		}
+		var steps []string
+		for i := range ta.steps {
+			if ta.steps[i] != tb.steps[i] {
+				steps = append(steps, fmt.Sprint(i))
+			}
+		}
+		if len(steps) > 0 {
+			diff = append(diff, fmt.Sprintf("track %d: steps %s differ", ta.id, strings.Join(steps, ", ")))
+		}
+	}
+	for _, tb := range b.tracks {
+		if _, ok := byID[tb.id]; ok {
+			diff = append(diff, fmt.Sprintf("track %d: added %s", tb.id, tb))
+		}
+	}
+	return diff
+}
@@ -0,0 +1,29 @@
+package drum
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a := decodeFixture(t, "pattern_1.splice")
+	if diff := Diff(a, a.Clone()); len(diff) != 0 {
+		t.Fatalf("Unexpected differences of identical patterns %q", diff)
+	}
+
+	b := a.Clone()
+	b.SetTempo(128)
+	b.tracks[1].steps[3] = 1
+	b.RemoveTrackByID(5)
+	b.AddTrack(6, "rim", make([]byte, 16))
+
+	expected := []string{
+		"tempo: 120 -> 128",
+		"track 1: steps 3 differ",
+		"track 5: removed (5) cowbell\t|----|----|--x-|----|",
+		"track 6: added (6) rim\t|----|----|----|----|",
+	}
+	if diff := Diff(a, b); !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Unexpected result: %q, expected %q", diff, expected)
+	}
+}
@@ -0,0 +1,75 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxVersionLen is the longest version Encode writes, leaving at least
+// one zero byte of padding in the 32 byte version field.
+const maxVersionLen = 31
+
+// ErrVersionTooLong is returned by Encode for a version longer than
+// 31 bytes. It may be wrapped, test for it with errors.Is.
+var ErrVersionTooLong = errors.New("version too long")
+
+// EncodeFile encodes the pattern into the drum machine file
+// at the provided path, creating or truncating it.
+func EncodeFile(p *Pattern, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = Encode(f, p); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Encode writes the pattern to w in the .splice format:
+// the SPLICE header and the big-endian length of the content,
+// followed by the version zero padded to 32 bytes, the tempo and the
+// tracks, followed by the trailing bytes of a decoded pattern if any.
+// A version must not exceed 31 bytes, see ErrVersionTooLong, and all
+// tracks need the same number of steps, 16, 32 or 64, see Track.Resize.
+func Encode(w io.Writer, p *Pattern) error {
+	buf := new(bytes.Buffer)
+	if len(p.version) > maxVersionLen {
+		return fmt.Errorf("%w: %q exceeds %d bytes", ErrVersionTooLong, p.version, maxVersionLen)
+	}
+	for _, t := range p.tracks {
+		if n := len(p.tracks[0].steps); len(t.steps) != n {
+			return fmt.Errorf("track %d: want %d steps, got %d", t.id, n, len(t.steps))
+		} else if !validStepCount(n) {
+			return fmt.Errorf("track %d: want 16, 32 or 64 steps, got %d", t.id, n)
+		}
+	}
+	version := make([]byte, 32)
+	copy(version, p.version)
+	buf.Write(version)
+	binary.Write(buf, binary.LittleEndian, p.tempo)
+	for _, t := range p.tracks {
+		if len(t.name) > 255 {
+			return fmt.Errorf("name of track %d exceeds 255 bytes", t.id)
+		}
+		binary.Write(buf, binary.LittleEndian, t.id)
+		buf.WriteByte(byte(len(t.name)))
+		buf.WriteString(t.name)
+		buf.Write(t.steps)
+	}
+	buf.Write(p.trailing)
+
+	if _, err := io.WriteString(w, "SPLICE"); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, int64(buf.Len())); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
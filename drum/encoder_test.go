@@ -0,0 +1,178 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, name := range []string{
+		"pattern_1.splice",
+		"pattern_2.splice",
+		"pattern_3.splice",
+		"pattern_4.splice",
+		"pattern_5.splice",
+	} {
+		golden, err := ioutil.ReadFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// anything beyond the declared length is not part of the pattern
+		golden = golden[:14+binary.BigEndian.Uint64(golden[6:14])]
+
+		decoded, err := DecodeFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatalf("something went wrong decoding %s - %v", name, err)
+		}
+		buf := new(bytes.Buffer)
+		if err := Encode(buf, decoded); err != nil {
+			t.Fatalf("something went wrong encoding %s - %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Fatalf("%s wasn't encoded as expected.\nGot:\n% x\nExpected:\n% x",
+				name, buf.Bytes(), golden)
+		}
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := path.Join(t.TempDir(), "pattern_1.splice")
+	if err := EncodeFile(decoded, out); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := DecodeFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread.String() != decoded.String() {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", reread, decoded)
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	tData := []struct {
+		version string
+		err     error
+	}{
+		{"0.808-alpha", nil},
+		{strings.Repeat("v", maxVersionLen), nil},
+		{strings.Repeat("v", maxVersionLen+1), ErrVersionTooLong},
+	}
+	for _, exp := range tData {
+		buf := new(bytes.Buffer)
+		err := Encode(buf, &Pattern{version: exp.version, tempo: 120})
+		if !errors.Is(err, exp.err) {
+			t.Fatalf("%q: unexpected error: %v, expected %v", exp.version, err, exp.err)
+		}
+		if err != nil {
+			continue
+		}
+		// SPLICE, the length, then the version field
+		field := buf.Bytes()[14 : 14+32]
+		padding := bytes.Repeat([]byte{0}, 32-len(exp.version))
+		if !bytes.HasPrefix(field, []byte(exp.version)) || !bytes.HasSuffix(field, padding) {
+			t.Fatalf("%q: unexpected version field % x", exp.version, field)
+		}
+		p, err := Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Version() != exp.version {
+			t.Fatalf("Unexpected version %q, expected %q", p.Version(), exp.version)
+		}
+	}
+}
+
+func TestEncodeStepCount(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+	for _, tr := range p.tracks {
+		tr.Resize(32)
+	}
+	if err := Encode(ioutil.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snare alone
+	p.tracks[1].Resize(16)
+	exp := "track 1: want 32 steps, got 16"
+	if err := Encode(ioutil.Discard, p); err == nil || err.Error() != exp {
+		t.Fatalf("Unexpected error %v, expected %q", err, exp)
+	}
+
+	tData := []struct {
+		n   int
+		err string
+	}{
+		{8, "track 0: want 16, 32 or 64 steps, got 8"},
+		{48, "track 0: want 16, 32 or 64 steps, got 48"},
+	}
+	for _, exp := range tData {
+		for _, tr := range p.tracks {
+			tr.Resize(exp.n)
+		}
+		if err := Encode(ioutil.Discard, p); err == nil || err.Error() != exp.err {
+			t.Fatalf("%d steps: unexpected error %v, expected %q", exp.n, err, exp.err)
+		}
+	}
+
+}
+
+func TestEncodeTrailing(t *testing.T) {
+	p32, err := NewPatternBuilder("0.909", 98.4).
+		Track(0, "kick", strings.Repeat("x---", 8)).
+		Track(1, "snare", strings.Repeat("--x-", 8)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, p32); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []struct {
+		name     string
+		content  []byte
+		trailing []byte
+		steps    int
+	}{
+		{"16 steps", fixture, []byte{0xde, 0xad, 0xbe, 0xef}, 16},
+		{"32 steps", buf.Bytes(), []byte{1, 2, 'a', 'b'}, 32},
+	} {
+		// append the quirk within the declared length
+		content := exp.content[:14+binary.BigEndian.Uint64(exp.content[6:14])]
+		golden := append(append([]byte(nil), content...), exp.trailing...)
+		binary.BigEndian.PutUint64(golden[6:14], uint64(len(golden)-14))
+
+		decoded, err := DecodeBytes(golden)
+		if err != nil {
+			t.Fatalf("%s: %v", exp.name, err)
+		}
+		if got := decoded.Trailing(); !bytes.Equal(got, exp.trailing) {
+			t.Fatalf("%s: unexpected trailing bytes % x, expected % x", exp.name, got, exp.trailing)
+		}
+		if n := decoded.stepCount(); n != exp.steps {
+			t.Fatalf("%s: unexpected step count %d, expected %d", exp.name, n, exp.steps)
+		}
+		out := new(bytes.Buffer)
+		if err := Encode(out, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), golden) {
+			t.Fatalf("%s wasn't encoded as expected.\nGot:\n% x\nExpected:\n% x", exp.name, out.Bytes(), golden)
+		}
+	}
+}
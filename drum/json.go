@@ -0,0 +1,123 @@
+package drum
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type patternJSON struct {
+	Version string   `json:"version"`
+	Tempo   float32  `json:"tempo"`
+	Swing   float32  `json:"swing,omitempty"`
+	Tracks  []*Track `json:"tracks"`
+}
+
+type trackJSON struct {
+	ID    int32  `json:"id"`
+	Name  string `json:"name"`
+	Steps []int  `json:"steps"`
+}
+
+// MarshalJSON encodes the pattern as an object
+// with version, tempo, swing if any and the array of tracks.
+func (p *Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(patternJSON{p.version, p.tempo, p.swing, p.tracks})
+}
+
+// UnmarshalJSON decodes a pattern encoded by MarshalJSON. The tracks
+// are added like by AddTrack, so they need valid and matching step
+// counts, distinct ids and steps of 0 or 1, see DecodeOptions.DecodeJSON
+// for velocities.
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	np, err := DecodeOptions{}.DecodeJSON(data)
+	if err != nil {
+		return err
+	}
+	*p = *np
+	return nil
+}
+
+// DecodeJSON decodes a pattern encoded by Pattern.MarshalJSON like its
+// UnmarshalJSON, but with o.AllowVelocity steps may be velocities up
+// to 255. The other options do not apply.
+func (o DecodeOptions) DecodeJSON(data []byte) (*Pattern, error) {
+	var pj patternJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return nil, err
+	}
+	p := &Pattern{version: pj.Version, tempo: pj.Tempo, swing: pj.Swing, tracks: make([]*Track, 0, len(pj.Tracks))}
+	for i, t := range pj.Tracks {
+		if t == nil {
+			return nil, fmt.Errorf("track %d of %d is null", i, len(pj.Tracks))
+		}
+		if err := p.checkTrack(t.id, t.name, len(t.steps)); err != nil {
+			return nil, err
+		}
+		for j, s := range t.steps {
+			if s > 1 && !o.AllowVelocity {
+				return nil, fmt.Errorf("track %d: invalid step value %#x at %d", t.id, s, j)
+			}
+		}
+		p.addTrack(t)
+	}
+	return p, nil
+}
+
+// MarshalJSON encodes the track as an object with id, name
+// and its steps as an array of velocities, 0s and 1s unless
+// decoded with DecodeOptions.AllowVelocity.
+func (t *Track) MarshalJSON() ([]byte, error) {
+	steps := make([]int, len(t.steps))
+	for i, s := range t.steps {
+		steps[i] = int(s)
+	}
+	return json.Marshal(trackJSON{t.id, t.name, steps})
+}
+
+// UnmarshalJSON decodes a track encoded by MarshalJSON, accepting
+// velocities from 0 to 255 as steps. Pattern.UnmarshalJSON only
+// accepts 0s and 1s though.
+func (t *Track) UnmarshalJSON(data []byte) error {
+	var tj trackJSON
+	if err := json.Unmarshal(data, &tj); err != nil {
+		return err
+	}
+	steps := make([]byte, len(tj.Steps))
+	for i, s := range tj.Steps {
+		if s < 0 || s > 255 {
+			return fmt.Errorf("track %d: invalid step value %d at %d", tj.ID, s, i)
+		}
+		steps[i] = byte(s)
+	}
+	*t = Track{tj.ID, tj.Name, steps}
+	return nil
+}
+
+// SpliceToJSON converts the .splice file at splicePath to JSON as encoded
+// by MarshalJSON, written to jsonPath.
+func SpliceToJSON(splicePath, jsonPath string) error {
+	p, err := DecodeFile(splicePath)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(jsonPath, append(data, '\n'), 0644)
+}
+
+// JSONToSplice converts the JSON file at jsonPath, as written by
+// SpliceToJSON, to a .splice file written to splicePath.
+func JSONToSplice(jsonPath, splicePath string) error {
+	data, err := ioutil.ReadFile(jsonPath)
+	if err != nil {
+		return err
+	}
+	p := new(Pattern)
+	if err := json.Unmarshal(data, p); err != nil {
+		return fmt.Errorf("%s: %w", jsonPath, err)
+	}
+	return EncodeFile(p, splicePath)
+}
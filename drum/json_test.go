@@ -0,0 +1,142 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := new(Pattern)
+	if err := json.Unmarshal(data, p); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, decoded) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s\nJSON:\n%s", p, decoded, data)
+	}
+}
+
+func TestJSONInvalidStep(t *testing.T) {
+	for _, step := range []string{"2", "256", "-1"} {
+		data := `{"version":"0.909","tempo":120,"tracks":[{"id":1,"name":"kick","steps":[1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,` + step + `]}]}`
+		if err := json.Unmarshal([]byte(data), new(Pattern)); err == nil {
+			t.Fatalf("step %s unmarshaled without error", step)
+		}
+	}
+}
+
+func TestJSONVelocityRoundTrip(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0x3b] = 127 // first step of the kick, an accent
+	decoded, err := DecodeOptions{AllowVelocity: true}.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeOptions{AllowVelocity: true}.DecodeJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equal(decoded) || p.Tracks()[0].Velocities()[0] != 127 {
+		t.Fatalf("Got:\n%s\nExpected:\n%s\nJSON:\n%s", p, decoded, data)
+	}
+
+	// only when asked for
+	exp := "track 0: invalid step value 0x7f at 0"
+	if err := json.Unmarshal(data, new(Pattern)); err == nil || err.Error() != exp {
+		t.Fatalf("Unexpected error %v, expected %q", err, exp)
+	}
+	dir := t.TempDir()
+	jsonPath := path.Join(dir, "velocity.json")
+	if err := ioutil.WriteFile(jsonPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := JSONToSplice(jsonPath, path.Join(dir, "velocity.splice")); err == nil {
+		t.Fatal("JSONToSplice wrote velocities without error")
+	}
+}
+
+func TestJSONInvalidTracks(t *testing.T) {
+	steps16 := `[1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0]`
+	steps32 := `[1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0,1,0,0,0]`
+	tData := []struct {
+		name   string
+		tracks string
+	}{
+		{"null track", `[null]`},
+		{"null after track", `[{"id":1,"name":"kick","steps":` + steps16 + `},null]`},
+		{"step count", `[{"id":1,"name":"kick","steps":[1,0,0,0]}]`},
+		{"mismatched step counts", `[{"id":1,"name":"kick","steps":` + steps16 + `},{"id":2,"name":"snare","steps":` + steps32 + `}]`},
+		{"long name", `[{"id":1,"name":"` + strings.Repeat("k", 256) + `","steps":` + steps16 + `}]`},
+		{"duplicate id", `[{"id":1,"name":"kick","steps":` + steps16 + `},{"id":1,"name":"snare","steps":` + steps16 + `}]`},
+	}
+	dir := t.TempDir()
+	for _, exp := range tData {
+		data := `{"version":"0.909","tempo":120,"tracks":` + exp.tracks + `}`
+		if err := json.Unmarshal([]byte(data), new(Pattern)); err == nil {
+			t.Fatalf("%s: unmarshaled without error", exp.name)
+		}
+		jsonPath := path.Join(dir, "pattern.json")
+		if err := ioutil.WriteFile(jsonPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := JSONToSplice(jsonPath, path.Join(dir, "pattern.splice")); err == nil {
+			t.Fatalf("%s: converted without error", exp.name)
+		}
+	}
+}
+
+func TestSpliceJSONFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"pattern_1.splice", "pattern_4.splice"} {
+		golden, err := ioutil.ReadFile(path.Join("fixtures", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// anything beyond the declared length is not part of the pattern
+		golden = golden[:14+binary.BigEndian.Uint64(golden[6:14])]
+
+		jsonPath := path.Join(dir, name+".json")
+		if err := SpliceToJSON(path.Join("fixtures", name), jsonPath); err != nil {
+			t.Fatal(err)
+		}
+		splicePath := path.Join(dir, name)
+		if err := JSONToSplice(jsonPath, splicePath); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(splicePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, golden) {
+			t.Fatalf("%s wasn't converted back as expected.\nGot:\n% x\nExpected:\n% x", name, got, golden)
+		}
+	}
+
+	invalid := path.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := JSONToSplice(invalid, path.Join(dir, "invalid.splice")); err == nil {
+		t.Fatal("Unexpected result: converted invalid JSON")
+	}
+}
@@ -0,0 +1,139 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	midiDivision  = 96                 // ticks per quarter note
+	midiStepTicks = midiDivision / 4   // a step is a sixteenth note
+	midiNoteTicks = midiStepTicks / 2  // length of a hit
+	midiChannel   = 9                  // channel 10 is percussion
+	midiNoteOn    = 0x90 | midiChannel // note on, channel 10
+	midiNoteOff   = 0x80 | midiChannel // note off, channel 10
+	midiVelocity  = 100
+	midiFallback  = 37 // side stick
+)
+
+// gmDrums maps parts of track names to General MIDI percussion notes,
+// the first match wins.
+var gmDrums = []struct {
+	name string
+	note byte
+}{
+	{"kick", 36},
+	{"snare", 38},
+	{"clap", 39},
+	{"open", 46},
+	{"hh", 42},
+	{"hihat", 42},
+	{"hi-hat", 42},
+	{"cowbell", 56},
+	{"low-tom", 45},
+	{"mid-tom", 47},
+	{"hi-tom", 50},
+	{"tom", 47},
+	{"conga", 64},
+	{"maracas", 70},
+	{"crash", 49},
+	{"ride", 51},
+	{"rim", 37},
+}
+
+// midiNote returns the General MIDI percussion note for a track name.
+func midiNote(name string) byte {
+	name = strings.ToLower(name)
+	for _, d := range gmDrums {
+		if strings.Contains(name, d.name) {
+			return d.note
+		}
+	}
+	return midiFallback
+}
+
+type midiEvent struct {
+	tick   uint32
+	status byte
+	note   byte
+}
+
+// WriteMIDI writes one loop of the pattern to w as a standard MIDI file.
+// Every track plays a General MIDI percussion note on channel 10,
+// chosen by its name, each step lasting a sixteenth note at the
+// pattern's tempo, every second one delayed by the pattern's swing.
+// Muted tracks, or all but the soloed ones, are left out. Tempos
+// the file cannot hold, like those below about 3.6 bpm, are an error.
+func WriteMIDI(w io.Writer, p *Pattern) error {
+	// tempo in microseconds per quarter note, stored in 24 bits
+	usec := 60e6 / float64(p.tempo)
+	if !(usec >= 1 && usec <= 0xffffff) {
+		return fmt.Errorf("cannot write tempo %g to MIDI", p.tempo)
+	}
+	var events []midiEvent
+	for _, t := range p.tracks {
+		if !p.audible(t) {
+			continue
+		}
+		note := midiNote(t.name)
+		for i, s := range t.steps {
+			if s == 0 {
+				continue
+			}
+			tick := uint32(i*midiStepTicks) + uint32(p.swingDelay(i)*midiStepTicks)
+			events = append(events,
+				midiEvent{tick, midiNoteOn, note},
+				midiEvent{tick + midiNoteTicks, midiNoteOff, note})
+		}
+	}
+	// note offs go first when sharing a tick with note ons
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].tick != events[j].tick {
+			return events[i].tick < events[j].tick
+		}
+		return events[i].status == midiNoteOff && events[j].status == midiNoteOn
+	})
+
+	trk := new(bytes.Buffer)
+	tempo := uint32(usec)
+	trk.Write([]byte{0, 0xff, 0x51, 3, byte(tempo >> 16), byte(tempo >> 8), byte(tempo)})
+	var last uint32
+	for _, e := range events {
+		writeVarLen(trk, e.tick-last)
+		trk.Write([]byte{e.status, e.note, midiVelocity})
+		last = e.tick
+	}
+	// end of track after the whole loop, or the last note off
+	// if swing pushed it beyond
+	end := uint32(p.stepCount() * midiStepTicks)
+	if last > end {
+		end = last
+	}
+	writeVarLen(trk, end-last)
+	trk.Write([]byte{0xff, 0x2f, 0})
+
+	hdr := new(bytes.Buffer)
+	hdr.WriteString("MThd")
+	binary.Write(hdr, binary.BigEndian, []uint32{6})
+	binary.Write(hdr, binary.BigEndian, []uint16{0, 1, midiDivision}) // format 0, one track
+	hdr.WriteString("MTrk")
+	binary.Write(hdr, binary.BigEndian, uint32(trk.Len()))
+	if _, err := hdr.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := trk.WriteTo(w)
+	return err
+}
+
+// writeVarLen writes v as a MIDI variable length quantity.
+func writeVarLen(buf *bytes.Buffer, v uint32) {
+	b := []byte{byte(v & 0x7f)}
+	for v >>= 7; v > 0; v >>= 7 {
+		b = append([]byte{byte(v&0x7f) | 0x80}, b...)
+	}
+	buf.Write(b)
+}
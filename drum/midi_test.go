@@ -0,0 +1,207 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+)
+
+type midiTestEvent struct {
+	tick   uint32
+	status byte
+	note   byte
+}
+
+// readMIDIEvents returns the note events of a format 0 MIDI file.
+func readMIDIEvents(t *testing.T, data []byte) []midiTestEvent {
+	if !bytes.HasPrefix(data, []byte("MThd")) {
+		t.Fatalf("missing MThd header: % x", data[:4])
+	}
+	trk := data[14:]
+	if !bytes.HasPrefix(trk, []byte("MTrk")) {
+		t.Fatalf("missing MTrk chunk: % x", trk[:4])
+	}
+	trk = trk[8 : 8+binary.BigEndian.Uint32(trk[4:8])]
+	var events []midiTestEvent
+	var tick uint32
+	for len(trk) > 0 {
+		var delta uint32
+		for {
+			b := trk[0]
+			trk = trk[1:]
+			delta = delta<<7 | uint32(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		tick += delta
+		if trk[0] == 0xff { // meta event
+			trk = trk[3+trk[2]:]
+			continue
+		}
+		events = append(events, midiTestEvent{tick, trk[0], trk[1]})
+		trk = trk[3:]
+	}
+	return events
+}
+
+func TestWriteMIDI(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+	buf := new(bytes.Buffer)
+	if err := WriteMIDI(buf, p); err != nil {
+		t.Fatal(err)
+	}
+
+	var hits int
+	for _, tr := range p.tracks {
+		for _, s := range tr.steps {
+			hits += int(s)
+		}
+	}
+	var on, off int
+	for _, e := range readMIDIEvents(t, buf.Bytes()) {
+		switch e.status {
+		case 0x99:
+			on++
+		case 0x89:
+			off++
+		default:
+			t.Fatalf("Unexpected event status %#x", e.status)
+		}
+	}
+	if on != hits || off != hits {
+		t.Fatalf("Unexpected events: %d note on, %d note off, expected %d each", on, off, hits)
+	}
+}
+
+func TestWriteMIDITempo(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+	for _, tempo := range []float32{0, -120, float32(math.NaN()), 3.5, 1e8} {
+		p.tempo = tempo
+		buf := new(bytes.Buffer)
+		if err := WriteMIDI(buf, p); err == nil {
+			t.Fatalf("tempo %g written without error", tempo)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("tempo %g: wrote %d bytes", tempo, buf.Len())
+		}
+	}
+
+	// slow, but still fitting the 24 bit field
+	p.tempo = 3.6
+	if err := WriteMIDI(ioutil.Discard, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMIDINote(t *testing.T) {
+	tData := []struct {
+		name string
+		note byte
+	}{
+		{"kick", 36},
+		{"SubKick", 36},
+		{"snare", 38},
+		{"hh-open", 46},
+		{"hh-close", 42},
+		{"Low Conga", 64},
+		{"cowbell", 56},
+		{"theremin", midiFallback},
+	}
+	for _, exp := range tData {
+		if got := midiNote(exp.name); got != exp.note {
+			t.Fatalf("%s: got note %d, expected %d", exp.name, got, exp.note)
+		}
+	}
+}
+
+func TestWriteMIDISwing(t *testing.T) {
+	p, err := NewPatternBuilder("0.808-alpha", 120).
+		Track(0, "hh", "xxxx------------").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Swing(80); err == nil {
+		t.Fatal("swing beyond 75% set without error")
+	}
+	if err := p.Swing(50); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := WriteMIDI(buf, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// off-beat steps are delayed by half a step of 24 ticks
+	var ticks []uint32
+	for _, e := range readMIDIEvents(t, buf.Bytes()) {
+		if e.status == 0x99 {
+			ticks = append(ticks, e.tick)
+		}
+	}
+	expected := []uint32{0, 36, 48, 84}
+	if len(ticks) != len(expected) {
+		t.Fatalf("Unexpected note on ticks %v, expected %v", ticks, expected)
+	}
+	for i := range expected {
+		if ticks[i] != expected[i] {
+			t.Fatalf("Unexpected note on ticks %v, expected %v", ticks, expected)
+		}
+	}
+}
+
+func TestWriteMIDIMuteSolo(t *testing.T) {
+	p, err := NewPatternBuilder("0.808-alpha", 120).
+		Track(0, "kick", "x---x---x---x---").
+		Track(1, "snare", "----x-------x---").
+		Track(2, "hh", "x-x-x-x-x-x-x-x-").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notesOn := func() map[byte]int {
+		buf := new(bytes.Buffer)
+		if err := WriteMIDI(buf, p); err != nil {
+			t.Fatal(err)
+		}
+		notes := make(map[byte]int)
+		for _, e := range readMIDIEvents(t, buf.Bytes()) {
+			if e.status == 0x99 {
+				notes[e.note]++
+			}
+		}
+		return notes
+	}
+
+	tData := []struct {
+		name               string
+		change             func()
+		kick, snare, hihat int
+	}{
+		{"none", func() {}, 4, 2, 8},
+		{"mute snare", func() { p.SetMuted(1, true) }, 4, 0, 8},
+		{"solo hh", func() { p.SetSoloed(2, true) }, 0, 0, 8},
+		{"solo muted snare", func() { p.SetSoloed(1, true) }, 0, 2, 8},
+		{"unsolo all", func() { p.SetSoloed(1, false); p.SetSoloed(2, false) }, 4, 0, 8},
+		{"unmute snare", func() { p.SetMuted(1, false) }, 4, 2, 8},
+	}
+	for _, exp := range tData {
+		exp.change()
+		notes := notesOn()
+		if notes[36] != exp.kick || notes[38] != exp.snare || notes[42] != exp.hihat {
+			t.Fatalf("%s: unexpected note ons %v", exp.name, notes)
+		}
+	}
+
+	p.SetMuted(0, true)
+	if s := p.String(); strings.Contains(s, "kick") || !strings.Contains(s, "snare") {
+		t.Fatalf("Unexpected result:\n%s", s)
+	}
+	if c := p.Clone(); c.String() != p.String() {
+		t.Fatalf("Unexpected result: clone\n%s\nexpected\n%s", c, p)
+	}
+}
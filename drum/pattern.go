@@ -0,0 +1,402 @@
+package drum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Equal reports whether p and other have the same version, tempo,
+// swing and tracks in the same order. Two nil patterns are equal,
+// a nil pattern never equals a non-nil one.
+func (p *Pattern) Equal(other *Pattern) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	if p.version != other.version || p.tempo != other.tempo || p.swing != other.swing ||
+		len(p.tracks) != len(other.tracks) {
+		return false
+	}
+	for i, t := range p.tracks {
+		if !t.Equal(other.tracks[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal reports whether t and other have the same id, name and steps.
+func (t *Track) Equal(other *Track) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+	return t.id == other.id && t.name == other.name && bytes.Equal(t.steps, other.steps)
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the version,
+// tempo, swing and tracks of p, to tell patterns apart by content.
+// It ignores the order of the tracks, hashing them sorted by id,
+// so patterns with the same tracks in another order share it.
+// Mute and solo states are no part of it.
+func (p *Pattern) Fingerprint() string {
+	tracks := append([]*Track(nil), p.tracks...)
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i].id != tracks[j].id {
+			return tracks[i].id < tracks[j].id
+		}
+		return tracks[i].name < tracks[j].name
+	})
+	h := sha256.New()
+	// lengths ahead of variable fields keep the encoding unambiguous
+	binary.Write(h, binary.BigEndian, uint32(len(p.version)))
+	h.Write([]byte(p.version))
+	binary.Write(h, binary.BigEndian, []float32{p.tempo, p.swing})
+	for _, t := range tracks {
+		binary.Write(h, binary.BigEndian, []int32{t.id, int32(len(t.name))})
+		h.Write([]byte(t.name))
+		binary.Write(h, binary.BigEndian, uint32(len(t.steps)))
+		h.Write(t.steps)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Clone returns a deep copy of p, sharing no tracks or steps with it.
+func (p *Pattern) Clone() *Pattern {
+	c := &Pattern{version: p.version, tempo: p.tempo, swing: p.swing, tracks: make([]*Track, 0, len(p.tracks)),
+		rawTempo: p.rawTempo, clamped: p.clamped, trailing: append([]byte(nil), p.trailing...)}
+	for _, t := range p.tracks {
+		c.addTrack(&Track{t.id, t.name, append([]byte(nil), t.steps...)})
+	}
+	for id := range p.muted {
+		c.SetMuted(id, true)
+	}
+	for id := range p.soloed {
+		c.SetSoloed(id, true)
+	}
+	return c
+}
+
+// Shift rotates the steps of t right by n steps, or left for negative n,
+// steps moved past one end coming back at the other.
+func (t *Track) Shift(n int) {
+	l := len(t.steps)
+	if l == 0 {
+		return
+	}
+	n = ((n % l) + l) % l
+	t.steps = append(append(make([]byte, 0, l), t.steps[l-n:]...), t.steps[:l-n]...)
+}
+
+// Resize makes t n steps long: extra steps are rests, shrinking drops
+// the steps beyond n for good. A negative n counts as 0. Resize the
+// other tracks of a pattern alike, e.g. from 16 to 32 steps, as Encode
+// only writes patterns of 16, 32 or 64 steps per track.
+func (t *Track) Resize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	steps := make([]byte, n)
+	copy(steps, t.steps)
+	t.steps = steps
+}
+
+// Merge returns a new pattern with the version and tempo of base,
+// holding the tracks of base with the tracks of overlay laid over them:
+// a track of overlay with the id of a track of base adds its hits
+// to those of the base track, any other one is appended.
+// Patterns with different step counts cannot be merged.
+func Merge(base, overlay *Pattern) (*Pattern, error) {
+	m := base.Clone()
+	for _, o := range overlay.tracks {
+		var t *Track
+		for _, b := range m.tracks {
+			if b.id == o.id {
+				t = b
+				break
+			}
+		}
+		if t == nil {
+			if err := m.AddTrack(o.id, o.name, o.steps); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(t.steps) != len(o.steps) {
+			return nil, fmt.Errorf("track %d: cannot merge %d steps into %d", o.id, len(o.steps), len(t.steps))
+		}
+		for i, s := range o.steps {
+			t.steps[i] |= s
+		}
+	}
+	return m, nil
+}
+
+// AddTrack appends a track with a copy of the given steps
+// to the pattern. steps needs 16, 32 or 64 values, each 0 or 1,
+// as many as the steps of the pattern's other tracks.
+func (p *Pattern) AddTrack(id int32, name string, steps []byte) error {
+	if err := p.checkTrack(id, name, len(steps)); err != nil {
+		return err
+	}
+	for i, s := range steps {
+		if s > 1 {
+			return fmt.Errorf("track %d: invalid step value %#x at %d", id, s, i)
+		}
+	}
+	p.addTrack(&Track{id, name, append([]byte(nil), steps...)})
+	return nil
+}
+
+// checkTrack checks whether a track with id, name and n steps fits
+// into the pattern, whatever the values of the steps.
+func (p *Pattern) checkTrack(id int32, name string, n int) error {
+	if len(p.tracks) > 0 {
+		if want := len(p.tracks[0].steps); n != want {
+			return fmt.Errorf("track %d: want %d steps, got %d", id, want, n)
+		}
+	} else if !validStepCount(n) {
+		return fmt.Errorf("track %d: want 16, 32 or 64 steps, got %d", id, n)
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("track %d: name exceeds 255 bytes", id)
+	}
+	for _, t := range p.tracks {
+		if t.id == id {
+			return fmt.Errorf("track %d exists", id)
+		}
+	}
+	return nil
+}
+
+// RemoveTrackByID removes the track with the given id
+// and reports whether there was one.
+func (p *Pattern) RemoveTrackByID(id int32) bool {
+	for i, t := range p.tracks {
+		if t.id == id {
+			p.tracks = append(p.tracks[:i], p.tracks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetStep turns step index of the track with id trackID on or off.
+func (p *Pattern) SetStep(trackID int32, index int, on bool) error {
+	for _, t := range p.tracks {
+		if t.id != trackID {
+			continue
+		}
+		if index < 0 || index >= len(t.steps) {
+			return fmt.Errorf("track %d: step %d out of range [0, %d)", trackID, index, len(t.steps))
+		}
+		t.steps[index] = 0
+		if on {
+			t.steps[index] = 1
+		}
+		return nil
+	}
+	return fmt.Errorf("no track %d", trackID)
+}
+
+// Swing sets the swing of the pattern: every second step, the off-beat
+// sixteenths, is delayed by percent of a step when rendered by
+// RenderWAV and WriteMIDI. percent must be within [0, 75].
+// The .splice format has no room for it, Encode drops it.
+func (p *Pattern) Swing(percent float32) error {
+	if percent < 0 || percent > 75 {
+		return fmt.Errorf("swing %g%% out of range [0, 75]", percent)
+	}
+	p.swing = percent
+	return nil
+}
+
+// swingDelay returns by how much of a step the step at index i is delayed.
+func (p *Pattern) swingDelay(i int) float32 {
+	if i%2 == 0 {
+		return 0
+	}
+	return p.swing / 100
+}
+
+// SetMuted mutes or unmutes the track with id trackID: String, RenderWAV
+// and WriteMIDI leave out a muted track unless it is soloed.
+// Like soloing, muting leaves the steps alone and is no part of
+// the pattern's content, Equal, Diff and Encode ignore it.
+func (p *Pattern) SetMuted(trackID int32, muted bool) {
+	if p.muted == nil {
+		p.muted = make(map[int32]bool)
+	}
+	if muted {
+		p.muted[trackID] = true
+	} else {
+		delete(p.muted, trackID)
+	}
+}
+
+// SetSoloed solos or unsolos the track with id trackID: as long as
+// any track is soloed, String, RenderWAV and WriteMIDI leave out
+// all tracks but the soloed ones, whether muted or not.
+func (p *Pattern) SetSoloed(trackID int32, soloed bool) {
+	if p.soloed == nil {
+		p.soloed = make(map[int32]bool)
+	}
+	if soloed {
+		p.soloed[trackID] = true
+	} else {
+		delete(p.soloed, trackID)
+	}
+}
+
+// audible reports whether t sounds given the muted and soloed tracks.
+func (p *Pattern) audible(t *Track) bool {
+	if len(p.soloed) > 0 {
+		return p.soloed[t.id]
+	}
+	return !p.muted[t.id]
+}
+
+// RenameTracks renames every track whose name is a key of mapping
+// to the value of that key, e.g. to switch to another drum kit.
+// The other tracks keep their names.
+func (p *Pattern) RenameTracks(mapping map[string]string) {
+	for _, t := range p.tracks {
+		if name, ok := mapping[t.name]; ok {
+			t.name = name
+		}
+	}
+}
+
+// StepTimes returns the offsets of the hits of the track with id trackID
+// from the start of the loop. With four beats to the bar and a step
+// lasting a sixteenth note, a step takes 60s / tempo / 4, every second
+// one being delayed by the pattern's swing.
+func (p *Pattern) StepTimes(trackID int32) ([]time.Duration, error) {
+	if !(p.tempo > 0) {
+		return nil, fmt.Errorf("cannot time tempo %g", p.tempo)
+	}
+	step := float64(time.Minute) / float64(p.tempo) / 4
+	for _, t := range p.tracks {
+		if t.id != trackID {
+			continue
+		}
+		times := make([]time.Duration, 0, len(t.steps))
+		for i, s := range t.steps {
+			if s != 0 {
+				times = append(times, time.Duration((float64(i)+float64(p.swingDelay(i)))*step))
+			}
+		}
+		return times, nil
+	}
+	return nil, fmt.Errorf("no track %d", trackID)
+}
+
+// SetTempo sets the tempo in beats per minute.
+func (p *Pattern) SetTempo(t float32) {
+	p.tempo = t
+	p.clamped = false
+}
+
+// ClampTempo constrains the tempo into [min, max], min <= max:
+// a tempo below min becomes min, as does NaN, one above max becomes max.
+// RawTempo keeps returning the tempo before clamping.
+func (p *Pattern) ClampTempo(min, max float32) {
+	t := p.tempo
+	switch {
+	case !(t >= min):
+		t = min
+	case t > max:
+		t = max
+	default:
+		return
+	}
+	if !p.clamped {
+		p.rawTempo, p.clamped = p.tempo, true
+	}
+	p.tempo = t
+}
+
+// RawTempo returns the tempo the pattern was decoded or set with,
+// ignoring ClampTempo.
+func (p *Pattern) RawTempo() float32 {
+	if p.clamped {
+		return p.rawTempo
+	}
+	return p.tempo
+}
+
+func validStepCount(n int) bool {
+	for _, c := range stepCounts {
+		if n == c {
+			return true
+		}
+	}
+	return false
+}
+
+// TrackByName returns the first track named name
+// and reports whether there is one.
+func (p *Pattern) TrackByName(name string) (*Track, bool) {
+	for _, t := range p.tracks {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// TrackNames returns the names of the tracks in file order.
+func (p *Pattern) TrackNames() []string {
+	names := make([]string, len(p.tracks))
+	for i, t := range p.tracks {
+		names[i] = t.name
+	}
+	return names
+}
+
+// TotalHits returns the number of hits of all tracks.
+func (p *Pattern) TotalHits() int {
+	var n int
+	for _, t := range p.tracks {
+		n += t.HitCount()
+	}
+	return n
+}
+
+// Matrix returns the steps of the pattern indexed by track, in file
+// order, then step, true for a hit. Every row is as long as its track,
+// so tracks of different step counts make a ragged matrix.
+func (p *Pattern) Matrix() [][]bool {
+	m := make([][]bool, len(p.tracks))
+	for i, t := range p.tracks {
+		m[i] = make([]bool, len(t.steps))
+		for j, s := range t.steps {
+			m[i][j] = s != 0
+		}
+	}
+	return m
+}
+
+// EachTrack calls fn for each track of the pattern in file order,
+// stopping at and returning the first error fn returns.
+func (p *Pattern) EachTrack(fn func(*Track) error) error {
+	for _, t := range p.tracks {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trailing returns a copy of the bytes following the last track within
+// the declared length: fewer than the 5 bytes of the id and name length
+// of another track, or a partial track if decoded with
+// DecodeOptions.AllowPartialTrack. Encode writes them back, so quirky
+// files survive a round trip. Meta.ExtraBytes counts the bytes beyond
+// the declared length instead.
+func (p *Pattern) Trailing() []byte {
+	return append([]byte(nil), p.trailing...)
+}
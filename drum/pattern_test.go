@@ -0,0 +1,440 @@
+package drum
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeFixture(t *testing.T, name string) *Pattern {
+	p, err := DecodeFile(path.Join("fixtures", name))
+	if err != nil {
+		t.Fatalf("something went wrong decoding %s - %v", name, err)
+	}
+	return p
+}
+
+func TestPatternEqual(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+
+	tempo := decodeFixture(t, "pattern_1.splice")
+	tempo.tempo++
+
+	reordered := decodeFixture(t, "pattern_1.splice")
+	reordered.tracks[0], reordered.tracks[1] = reordered.tracks[1], reordered.tracks[0]
+
+	tData := []struct {
+		name  string
+		a, b  *Pattern
+		equal bool
+	}{
+		{"identical", p, decodeFixture(t, "pattern_1.splice"), true},
+		{"tempo", p, tempo, false},
+		{"reordered tracks", p, reordered, false},
+		{"other pattern", p, decodeFixture(t, "pattern_2.splice"), false},
+		{"nil", nil, nil, true},
+		{"nil and non-nil", nil, p, false},
+		{"non-nil and nil", p, nil, false},
+	}
+	for _, exp := range tData {
+		if got := exp.a.Equal(exp.b); got != exp.equal {
+			t.Fatalf("%s: Equal returned %t, expected %t", exp.name, got, exp.equal)
+		}
+	}
+}
+
+func TestPatternFingerprint(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+
+	tempo := decodeFixture(t, "pattern_1.splice")
+	tempo.tempo++
+
+	reordered := decodeFixture(t, "pattern_1.splice")
+	reordered.tracks[0], reordered.tracks[5] = reordered.tracks[5], reordered.tracks[0]
+
+	step := decodeFixture(t, "pattern_1.splice")
+	step.tracks[0].steps[1] = 1
+
+	tData := []struct {
+		name string
+		a, b *Pattern
+		same bool
+	}{
+		{"identical", p, decodeFixture(t, "pattern_1.splice"), true},
+		{"reordered tracks", p, reordered, true},
+		{"tempo", p, tempo, false},
+		{"step", p, step, false},
+		{"other pattern", p, decodeFixture(t, "pattern_2.splice"), false},
+	}
+	for _, exp := range tData {
+		if got := exp.a.Fingerprint() == exp.b.Fingerprint(); got != exp.same {
+			t.Fatalf("%s: same fingerprint %t, expected %t", exp.name, got, exp.same)
+		}
+	}
+	if f := p.Fingerprint(); len(f) != 64 {
+		t.Fatalf("Unexpected fingerprint %q", f)
+	}
+}
+
+func TestPatternEdit(t *testing.T) {
+	p := decodeFixture(t, "pattern_2.splice")
+
+	steps := []byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}
+	if err := p.AddTrack(7, "clap", steps); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddTrack(8, "short", steps[:15]); err == nil {
+		t.Fatal("15 step track added without error")
+	}
+	if err := p.AddTrack(9, "invalid", append(steps[:15:15], 2)); err == nil {
+		t.Fatal("track with invalid step added without error")
+	}
+	if err := p.AddTrack(7, "duplicate", steps); err == nil {
+		t.Fatal("track with existing id added without error")
+	}
+
+	if !p.RemoveTrackByID(1) {
+		t.Fatal("existing track 1 was not removed")
+	}
+	if p.RemoveTrackByID(42) {
+		t.Fatal("non-existent track 42 was removed")
+	}
+	p.SetTempo(128)
+
+	expected := `Saved with HW Version: 0.808-alpha
+Tempo: 128
+(0) kick	|x---|----|x---|----|
+(3) hh-open	|--x-|--x-|x-x-|--x-|
+(5) cowbell	|----|----|x---|----|
+(7) clap	|x---|x---|x---|x---|
+`
+	if p.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", p, expected)
+	}
+}
+
+func TestPatternClone(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice")
+	c := p.Clone()
+	if !c.Equal(p) {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", c, p)
+	}
+
+	c.tracks[0].steps[1] = 1
+	c.tracks[1].name = "renamed"
+	c.SetTempo(60)
+	if !p.Equal(decodeFixture(t, "pattern_1.splice")) {
+		t.Fatalf("Mutating the clone changed the original:\n%s", p)
+	}
+}
+
+func TestTrackShift(t *testing.T) {
+	tData := []struct {
+		n      int
+		output string
+	}{
+		{0, "(0) kick\t|x-x-|---x|----|----|"},
+		{1, "(0) kick\t|-x-x|----|x---|----|"},
+		{-1, "(0) kick\t|-x--|--x-|----|---x|"},
+		{17, "(0) kick\t|-x-x|----|x---|----|"},
+		{-16, "(0) kick\t|x-x-|---x|----|----|"},
+	}
+	for _, exp := range tData {
+		tr := &Track{0, "kick", []byte{1, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}}
+		tr.Shift(exp.n)
+		if tr.String() != exp.output {
+			t.Fatalf("Shift(%d): Unexpected result %q, expected %q", exp.n, tr, exp.output)
+		}
+	}
+}
+
+func TestTrackResize(t *testing.T) {
+	steps := []byte{1, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}
+	tData := []struct {
+		n     int
+		steps []byte
+	}{
+		{16, steps},
+		{8, []byte{1, 0, 1, 0, 0, 0, 0, 1}},
+		{32, append(append([]byte(nil), steps...), make([]byte, 16)...)},
+		{0, []byte{}},
+		{-1, []byte{}},
+	}
+	for _, exp := range tData {
+		orig := append([]byte(nil), steps...)
+		tr := &Track{0, "kick", orig}
+		tr.Resize(exp.n)
+		if !reflect.DeepEqual(tr.steps, exp.steps) {
+			t.Fatalf("Resize(%d): Unexpected result %v, expected %v", exp.n, tr.steps, exp.steps)
+		}
+		// the steps are new, the old ones untouched
+		if exp.n > 0 {
+			tr.steps[0] = 0
+		}
+		if !reflect.DeepEqual(orig, steps) {
+			t.Fatalf("Resize(%d): changed the original steps to %v", exp.n, orig)
+		}
+	}
+}
+
+func TestPatternSetStep(t *testing.T) {
+	p := decodeFixture(t, "pattern_2.splice")
+
+	if err := p.SetStep(3, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.tracks[2].String(); s != "(3) hh-open\t|-xx-|--x-|x-x-|--x-|" {
+		t.Fatalf("Unexpected result %q after turning step 1 on", s)
+	}
+	if err := p.SetStep(3, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Equal(decodeFixture(t, "pattern_2.splice")) {
+		t.Fatalf("Unexpected result after turning step 1 off:\n%s", p)
+	}
+
+	tData := []struct {
+		id    int32
+		index int
+		err   string
+	}{
+		{3, 16, "track 3: step 16 out of range [0, 16)"},
+		{3, -1, "track 3: step -1 out of range [0, 16)"},
+		{2, 0, "no track 2"},
+	}
+	for _, exp := range tData {
+		if err := p.SetStep(exp.id, exp.index, true); err == nil || err.Error() != exp.err {
+			t.Fatalf("Unexpected error %v, expected %q", err, exp.err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	kick, err := NewPatternBuilder("0.808-alpha", 120).
+		Track(0, "kick", "x---x---x---x---").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hihat, err := NewPatternBuilder("0.909", 98).
+		Track(0, "kick", "--x---------x-x-").
+		Track(1, "hh", "x-x-x-x-x-x-x-x-").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := Merge(kick, hihat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Saved with HW Version: 0.808-alpha
+Tempo: 120
+(0) kick	|x-x-|x---|x---|x-x-|
+(1) hh	|x-x-|x-x-|x-x-|x-x-|
+`
+	if merged.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", merged, expected)
+	}
+	if kick.tracks[0].String() != "(0) kick\t|x---|x---|x---|x---|" {
+		t.Fatalf("Merge changed the base pattern:\n%s", kick)
+	}
+
+	long, err := NewPatternBuilder("0.808-alpha", 120).
+		Track(0, "kick", "x---x---x---x---x---x---x---x---").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Merge(kick, long); err == nil {
+		t.Fatal("patterns with different step counts merged without error")
+	}
+}
+
+func TestRenameTracks(t *testing.T) {
+	p := decodeFixture(t, "pattern_4.splice")
+	p.RenameTracks(map[string]string{
+		"Kick":       "808 Kick",
+		"Maracas":    "Shaker",
+		"Tambourine": "Cowbell",
+	})
+	expected := `Saved with HW Version: 0.909
+Tempo: 240
+(0) SubKick	|----|----|----|----|
+(1) 808 Kick	|x---|----|x---|----|
+(99) Shaker	|x-x-|x-x-|x-x-|x-x-|
+(255) Low Conga	|----|x---|----|x---|
+`
+	if p.String() != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", p, expected)
+	}
+}
+
+func TestClampTempo(t *testing.T) {
+	p, err := NewPatternBuilder("0.808-alpha", 9999).
+		Track(0, "kick", "x---x---x---x---").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	wire := buf.Bytes()
+
+	decoded, err := DecodeOptions{MinTempo: 40, MaxTempo: 240}.Decode(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Tempo() != 240 || decoded.RawTempo() != 9999 {
+		t.Fatalf("Unexpected tempo %g, raw %g, expected 240, raw 9999", decoded.Tempo(), decoded.RawTempo())
+	}
+	if c := decoded.Clone(); c.RawTempo() != 9999 {
+		t.Fatalf("Unexpected raw tempo of clone %g", c.RawTempo())
+	}
+	if decoded, err = Decode(bytes.NewReader(wire)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Tempo() != 9999 {
+		t.Fatalf("Unexpected tempo %g without clamping", decoded.Tempo())
+	}
+
+	tData := []struct {
+		tempo, clamped float32
+	}{
+		{120, 120},
+		{-5, 40},
+		{9999, 240},
+		{float32(math.NaN()), 40},
+	}
+	for _, exp := range tData {
+		p.SetTempo(exp.tempo)
+		p.ClampTempo(40, 240)
+		if p.Tempo() != exp.clamped {
+			t.Fatalf("ClampTempo(40, 240) of %g: unexpected tempo %g, expected %g", exp.tempo, p.Tempo(), exp.clamped)
+		}
+		if raw := p.RawTempo(); raw != exp.tempo && !math.IsNaN(float64(exp.tempo)) {
+			t.Fatalf("Unexpected raw tempo %g, expected %g", raw, exp.tempo)
+		}
+	}
+}
+
+func TestStepTimes(t *testing.T) {
+	p := decodeFixture(t, "pattern_1.splice") // 120 bpm
+
+	// a step of a sixteenth note lasts 125ms
+	times, err := p.StepTimes(3) // hh-open |--x-|--x-|x-x-|--x-|
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{250 * time.Millisecond, 750 * time.Millisecond,
+		time.Second, 1250 * time.Millisecond, 1750 * time.Millisecond}
+	if !reflect.DeepEqual(times, expected) {
+		t.Fatalf("Unexpected result: %v, expected %v", times, expected)
+	}
+
+	if _, err := p.StepTimes(42); err == nil {
+		t.Fatal("unknown track timed without error")
+	}
+
+	for _, tempo := range []float32{0, -120, float32(math.NaN())} {
+		p.tempo = tempo
+		if _, err := p.StepTimes(3); err == nil {
+			t.Fatalf("tempo %g timed without error", tempo)
+		}
+	}
+}
+
+func TestTrackByName(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_3.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := decoded.TrackNames()
+	expected := []string{"kick", "clap", "hh-open", "low-tom", "mid-tom", "hi-tom"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Unexpected names %q, expected %q", names, expected)
+	}
+
+	tr, ok := decoded.TrackByName("mid-tom")
+	if !ok || tr.ID() != 12 {
+		t.Fatalf("Unexpected result %v, %t for mid-tom", tr, ok)
+	}
+	if tr, ok := decoded.TrackByName("cowbell"); ok || tr != nil {
+		t.Fatalf("Unexpected result %v, %t for cowbell", tr, ok)
+	}
+
+	// the first of several tracks with the same name
+	decoded.AddTrack(13, "kick", make([]byte, 16))
+	if tr, _ := decoded.TrackByName("kick"); tr.ID() != 40 {
+		t.Fatalf("Unexpected track %d for kick, expected 40", tr.ID())
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []string{
+		"x---x---x---x---",
+		"----x-------x---",
+		"----x-x---------",
+		"--x---x-x-x---x-",
+		"x---x-------x--x",
+		"----------x-----",
+	}
+	m := decoded.Matrix()
+	if len(m) != len(rows) {
+		t.Fatalf("Unexpected result: %d rows, expected %d", len(m), len(rows))
+	}
+	for i, row := range rows {
+		if len(m[i]) != len(row) {
+			t.Fatalf("Unexpected result: row %d of %d steps, expected %d", i, len(m[i]), len(row))
+		}
+		for j := range row {
+			if m[i][j] != (row[j] == 'x') {
+				t.Fatalf("Unexpected result: step %d of row %d is %t", j, i, m[i][j])
+			}
+		}
+	}
+}
+
+func TestEachTrack(t *testing.T) {
+	decoded, err := DecodeFile(path.Join("fixtures", "pattern_1.splice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := decoded.EachTrack(func(*Track) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("Unexpected result: visited %d tracks, expected 6", n)
+	}
+
+	stop := errors.New("stop")
+	var names []string
+	err = decoded.EachTrack(func(tr *Track) error {
+		names = append(names, tr.Name())
+		if len(names) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("Unexpected error: %v, expected %v", err, stop)
+	}
+	if len(names) != 2 || names[1] != "snare" {
+		t.Fatalf("Unexpected result: visited %v", names)
+	}
+}
@@ -0,0 +1,67 @@
+package drum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseText parses a pattern in the text form rendered by Pattern.String:
+// an optional "Saved with HW Version:" line, a "Tempo:" line and one line
+// per track like "(0) kick |x---|x---|x---|x---|". Blank lines are skipped.
+func ParseText(r io.Reader) (*Pattern, error) {
+	p := &Pattern{tracks: make([]*Track, 0, 0)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if err := parseLine(p, line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseLine(p *Pattern, line string) error {
+	switch {
+	case line == "":
+	case strings.HasPrefix(line, "Saved with HW Version:"):
+		p.version = strings.TrimSpace(strings.TrimPrefix(line, "Saved with HW Version:"))
+	case strings.HasPrefix(strings.ToLower(line), "tempo:"):
+		tempo, err := strconv.ParseFloat(strings.TrimSpace(line[len("tempo:"):]), 32)
+		if err != nil {
+			return err
+		}
+		p.tempo = float32(tempo)
+	case strings.HasPrefix(line, "("):
+		end := strings.Index(line, ")")
+		bar := strings.Index(line, "|")
+		if end < 0 || bar < end {
+			return fmt.Errorf("malformed track %q", line)
+		}
+		id, err := strconv.ParseInt(line[1:end], 10, 32)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSpace(line[end+1 : bar])
+		var steps []byte
+		for i, c := range []byte(strings.Replace(line[bar:], "|", "", -1)) {
+			switch c {
+			case 'x':
+				steps = append(steps, 1)
+			case '-':
+				steps = append(steps, 0)
+			default:
+				return fmt.Errorf("track %d: invalid step %q at %d", id, c, i)
+			}
+		}
+		return p.AddTrack(int32(id), name, steps)
+	default:
+		return fmt.Errorf("unexpected %q", line)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package drum
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	text := `tempo: 98.4
+
+(0) kick |x---|----|x---|----|
+(99) Low Conga	|----|x---|----|x---|
+`
+	p, err := ParseText(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Tempo() != 98.4 {
+		t.Fatalf("Unexpected tempo %g", p.Tempo())
+	}
+	tData := []struct {
+		id    int32
+		name  string
+		steps []byte
+	}{
+		{0, "kick", []byte{1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{99, "Low Conga", []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0}},
+	}
+	tracks := p.Tracks()
+	if len(tracks) != len(tData) {
+		t.Fatalf("Unexpected number of tracks %d", len(tracks))
+	}
+	for i, exp := range tData {
+		tr := tracks[i]
+		if tr.ID() != exp.id || tr.Name() != exp.name || !bytes.Equal(tr.Steps(), exp.steps) {
+			t.Fatalf("Unexpected track (%d) %s %v, expected (%d) %s %v",
+				tr.ID(), tr.Name(), tr.Steps(), exp.id, exp.name, exp.steps)
+		}
+	}
+
+	if _, err := ParseText(strings.NewReader("(0) kick |x---|o---|x---|----|")); err == nil {
+		t.Fatal("invalid step parsed without error")
+	}
+}
+
+func TestParseTextRoundTrip(t *testing.T) {
+	for _, name := range []string{"pattern_1.splice", "pattern_2.splice", "pattern_4.splice"} {
+		p := decodeFixture(t, name)
+		parsed, err := ParseText(strings.NewReader(p.String()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !parsed.Equal(p) {
+			t.Fatalf("%s\nGot:\n%s\nExpected:\n%s", name, parsed, p)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// WAVSampleRate is the sample rate RenderWAV renders at.
+const WAVSampleRate = 44100
+
+// maxWAVSamples bounds the length of a loop RenderWAV renders,
+// ten minutes, so absurd tempos cannot exhaust memory.
+const maxWAVSamples = 10 * 60 * WAVSampleRate
+
+// click is the sound of tracks without a sample, a 10ms 1kHz
+// sine burst fading out, as 16-bit little-endian PCM.
+var click = func() []byte {
+	n := WAVSampleRate / 100
+	buf := make([]byte, 2*n)
+	for i := 0; i < n; i++ {
+		fade := 1 - float64(i)/float64(n)
+		v := 0.5 * fade * math.Sin(2*math.Pi*1000*float64(i)/WAVSampleRate)
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(int16(v*math.MaxInt16)))
+	}
+	return buf
+}()
+
+// RenderWAV renders one loop of the pattern as a mono 16-bit PCM WAV
+// to w. Each step lasts a sixteenth note at the pattern's tempo,
+// every second one delayed by the pattern's swing. Muted tracks,
+// or all but the soloed ones, are silent.
+// samples maps track names to their sound as mono 16-bit little-endian
+// PCM at WAVSampleRate; tracks without a sample play a short click.
+// Sounds reaching beyond the end of the loop wrap around to its start.
+// Tempos so fast that a step is shorter than a sample, or so slow
+// that the loop lasts longer than ten minutes, cannot be rendered.
+func RenderWAV(w io.Writer, p *Pattern, samples map[string][]byte) error {
+	if !(p.tempo > 0) {
+		return fmt.Errorf("cannot render tempo %g", p.tempo)
+	}
+	if l := WAVSampleRate * 15 / float64(p.tempo); l*float64(p.stepCount()) > maxWAVSamples {
+		return fmt.Errorf("cannot render tempo %g: loop exceeds %d samples", p.tempo, maxWAVSamples)
+	}
+	stepLen := int(WAVSampleRate * 15 / p.tempo) // 60s / tempo / 4
+	if stepLen < 1 {
+		return fmt.Errorf("cannot render tempo %g: step shorter than a sample", p.tempo)
+	}
+	mix := make([]int32, p.stepCount()*stepLen)
+	for _, t := range p.tracks {
+		if !p.audible(t) {
+			continue
+		}
+		sound, ok := samples[t.name]
+		if !ok {
+			sound = click
+		}
+		for i, s := range t.steps {
+			if s == 0 {
+				continue
+			}
+			start := i*stepLen + int(p.swingDelay(i)*float32(stepLen))
+			for j := 0; j+1 < len(sound); j += 2 {
+				v := int16(binary.LittleEndian.Uint16(sound[j:]))
+				mix[(start+j/2)%len(mix)] += int32(v)
+			}
+		}
+	}
+
+	data := new(bytes.Buffer)
+	for _, v := range mix {
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		binary.Write(data, binary.LittleEndian, int16(v))
+	}
+
+	hdr := new(bytes.Buffer)
+	hdr.WriteString("RIFF")
+	binary.Write(hdr, binary.LittleEndian, uint32(36+data.Len()))
+	hdr.WriteString("WAVE")
+	hdr.WriteString("fmt ")
+	binary.Write(hdr, binary.LittleEndian, wavFormat{
+		Size:       16,
+		Format:     1, // PCM
+		Channels:   1,
+		SampleRate: WAVSampleRate,
+		ByteRate:   2 * WAVSampleRate,
+		BlockAlign: 2,
+		Bits:       16,
+	})
+	hdr.WriteString("data")
+	binary.Write(hdr, binary.LittleEndian, uint32(data.Len()))
+	if _, err := hdr.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := data.WriteTo(w)
+	return err
+}
+
+// wavFormat is the content of a WAV fmt chunk, preceded by its size.
+type wavFormat struct {
+	Size       uint32
+	Format     uint16
+	Channels   uint16
+	SampleRate uint32
+	ByteRate   uint32
+	BlockAlign uint16
+	Bits       uint16
+}
@@ -0,0 +1,63 @@
+package drum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestRenderWAV(t *testing.T) {
+	p := &Pattern{version: "0.909", tempo: 120}
+	if err := p.AddTrack(1, "kick", []byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := RenderWAV(buf, p, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" ||
+		string(data[12:16]) != "fmt " || string(data[36:40]) != "data" {
+		t.Fatalf("Unexpected header: %q", data[:44])
+	}
+	if size := binary.LittleEndian.Uint32(data[4:8]); int(size) != len(data)-8 {
+		t.Fatalf("Unexpected RIFF size %d for %d bytes", size, len(data))
+	}
+	var format wavFormat
+	binary.Read(bytes.NewReader(data[16:36]), binary.LittleEndian, &format)
+	if format.Format != 1 || format.Channels != 1 || format.SampleRate != WAVSampleRate || format.Bits != 16 {
+		t.Fatalf("Unexpected format %+v", format)
+	}
+
+	// 16 sixteenth notes at 120 bpm last two seconds
+	expected := 16 * (WAVSampleRate * 15 / 120)
+	if n := binary.LittleEndian.Uint32(data[40:44]) / 2; n != uint32(expected) || len(data) != 44+2*expected {
+		t.Fatalf("Unexpected sample count %d, expected %d", n, expected)
+	}
+
+	// the click sounds at the start of the first step only
+	if v := int16(binary.LittleEndian.Uint16(data[44+2*10:])); v == 0 {
+		t.Fatal("Unexpected silence on the first step")
+	}
+	if v := int16(binary.LittleEndian.Uint16(data[44+2*(WAVSampleRate*15/120+10):])); v != 0 {
+		t.Fatalf("Unexpected sound %d on the second step", v)
+	}
+}
+
+func TestRenderWAVTempo(t *testing.T) {
+	for _, tempo := range []float32{0, -120, float32(math.NaN()), 1e6, 1e-3} {
+		p := &Pattern{version: "0.909", tempo: tempo}
+		if err := p.AddTrack(1, "kick", []byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := RenderWAV(buf, p, nil); err == nil {
+			t.Fatalf("tempo %g rendered without error", tempo)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("tempo %g: unexpected %d bytes written", tempo, buf.Len())
+		}
+	}
+}